@@ -0,0 +1,183 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+const apiKeyEnv = "STTRAY_API_KEY"
+const clientCertPasswordEnv = "STTRAY_CLIENT_CERT_PASSWORD"
+const passwordEnv = "STTRAY_PASSWORD"
+
+// keySource is one place the api key can come from, apiKey returns an empty
+// key if it has none
+type keySource interface {
+	String() string
+	apiKey() (string, error)
+}
+
+// keyStore is a keySource that can also save the key
+type keyStore interface {
+	keySource
+	available() bool
+	store(key string) error
+}
+
+// keyring is the secret store of the desktop, see keyring_*.go
+var keyring keyStore = newKeyring()
+
+type flagKey string
+
+func (k flagKey) String() string          { return "-api" }
+func (k flagKey) apiKey() (string, error) { return string(k), nil }
+
+type envKey string
+
+func (k envKey) String() string          { return "$" + string(k) }
+func (k envKey) apiKey() (string, error) { return os.Getenv(string(k)), nil }
+
+type fileKey string
+
+func (k fileKey) String() string { return string(k) }
+
+func (k fileKey) apiKey() (string, error) {
+	path := expandHome(string(k))
+	info, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	// permissions do not mean much on windows
+	if runtime.GOOS != "windows" && info.Mode().Perm()&0077 != 0 {
+		slog.Warn("secret file can be read by other users", "path", path, "mode", info.Mode().Perm())
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	key := strings.TrimSpace(string(data))
+	if key == "" {
+		return "", fmt.Errorf("file %s is empty", path)
+	}
+	return key, nil
+}
+
+// readSecret takes a password from its flag, from file or from the
+// environment variable env, the latter two keep it out of the process list
+func readSecret(value, file, env string) (string, error) {
+	if value != "" {
+		return value, nil
+	}
+	if file != "" {
+		return fileKey(file).apiKey()
+	}
+	return os.Getenv(env), nil
+}
+
+// configXmlKey is the key in the config.xml of a local syncthing, an empty
+// path if none was found
+type configXmlKey string
+
+func (k configXmlKey) String() string { return "config.xml of syncthing" }
+
+func (k configXmlKey) apiKey() (string, error) {
+	if k == "" {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(string(k))
+	if err != nil {
+		return "", err
+	}
+	var cfg struct {
+		ApiKey string `xml:"gui>apikey"`
+	}
+	if err := xml.Unmarshal(data, &cfg); err != nil {
+		return "", fmt.Errorf("%s: %v", k, err)
+	}
+	return strings.TrimSpace(cfg.ApiKey), nil
+}
+
+// syncthingConfigXml finds the config.xml in the default locations of
+// syncthing, newer versions use the state dir on linux
+func syncthingConfigXml() string {
+	var dirs []string
+	switch runtime.GOOS {
+	case "windows":
+		dirs = []string{filepath.Join(os.Getenv("LOCALAPPDATA"), "Syncthing")}
+	case "darwin":
+		dirs = []string{expandHome("~/Library/Application Support/Syncthing")}
+	default:
+		state := os.Getenv("XDG_STATE_HOME")
+		if state == "" {
+			state = expandHome("~/.local/state")
+		}
+		configDir := os.Getenv("XDG_CONFIG_HOME")
+		if configDir == "" {
+			configDir = expandHome("~/.config")
+		}
+		dirs = []string{filepath.Join(state, "syncthing"), filepath.Join(configDir, "syncthing")}
+	}
+	for _, dir := range dirs {
+		path := filepath.Join(dir, "config.xml")
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	return ""
+}
+
+// apiKeySources in the order they are tried, the config.xml is only read
+// for a syncthing on this machine
+func apiKeySources() []keySource {
+	sources := []keySource{flagKey(config.ApiKey)}
+	if config.apiKeyFile != "" {
+		sources = append(sources, fileKey(config.apiKeyFile))
+	}
+	sources = append(sources, envKey(apiKeyEnv), keyring)
+	if !remoteTarget() {
+		sources = append(sources, configXmlKey(syncthingConfigXml()))
+	}
+	return sources
+}
+
+// explicitSource is true for the sources given on the command line
+func explicitSource(source keySource) bool {
+	switch source.(type) {
+	case flagKey, fileKey:
+		return true
+	}
+	return false
+}
+
+// resolveApiKey takes the key from the first source that has one, no key is
+// fine for a GUI without authentication or with -user. a broken keyring or
+// config.xml only means the next source is tried.
+func resolveApiKey(sources []keySource) (string, keySource, error) {
+	for _, source := range sources {
+		key, err := source.apiKey()
+		if err != nil {
+			err = fmt.Errorf("could not read api key from %s: %v", source, err)
+			if explicitSource(source) {
+				return "", nil, err
+			}
+			slog.Warn("skipping api key source", "err", err)
+			continue
+		}
+		if key != "" {
+			return key, source, nil
+		}
+	}
+	return "", nil, nil
+}
+
+// canSaveApiKey is true if the key was given some other way and could be
+// kept in the keyring instead, the one from config.xml can be found again
+func canSaveApiKey() bool {
+	_, fromConfigXml := config.apiKeySource.(configXmlKey)
+	return config.ApiKey != "" && config.apiKeySource != keyring && !fromConfigXml && keyring.available()
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// fakeKey is a keySource with a fixed result
+type fakeKey struct {
+	name string
+	key  string
+	err  error
+}
+
+func (k fakeKey) String() string          { return k.name }
+func (k fakeKey) apiKey() (string, error) { return k.key, k.err }
+
+func TestResolveApiKey(t *testing.T) {
+	broken := errors.New("locked")
+	env := fakeKey{name: "env"}
+	keyringKey := fakeKey{name: "keyring", key: "from-keyring"}
+	keyringBroken := fakeKey{name: "keyring", err: broken}
+	configXml := fakeKey{name: "config.xml", key: "from-config-xml"}
+
+	cases := []struct {
+		name    string
+		sources []keySource
+		key     string
+		source  string
+		err     bool
+	}{
+		{"flag first", []keySource{flagKey("from-flag"), fakeKey{name: "env", key: "from-env"}, keyringKey, configXml}, "from-flag", "-api", false},
+		{"env before keyring", []keySource{flagKey(""), fakeKey{name: "env", key: "from-env"}, keyringKey, configXml}, "from-env", "env", false},
+		{"keyring before config.xml", []keySource{flagKey(""), env, keyringKey, configXml}, "from-keyring", "keyring", false},
+		{"config.xml last", []keySource{flagKey(""), env, fakeKey{name: "keyring"}, configXml}, "from-config-xml", "config.xml", false},
+		{"broken keyring falls through", []keySource{flagKey(""), env, keyringBroken, configXml}, "from-config-xml", "config.xml", false},
+		{"only broken sources", []keySource{flagKey(""), env, keyringBroken}, "", "", false},
+		{"no key", []keySource{flagKey(""), env}, "", "", false},
+		{"missing key file stops", []keySource{flagKey(""), fileKey(filepath.Join(t.TempDir(), "missing")), env, keyringKey}, "", "", true},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			key, source, err := resolveApiKey(c.sources)
+			if (err != nil) != c.err {
+				t.Fatalf("got error %v, want error %v", err, c.err)
+			}
+			if key != c.key {
+				t.Errorf("got key %q, want %q", key, c.key)
+			}
+			name := ""
+			if source != nil {
+				name = source.String()
+			}
+			if name != c.source {
+				t.Errorf("got source %q, want %q", name, c.source)
+			}
+		})
+	}
+}
+
+func TestConfigXmlKey(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.xml")
+	data := `<configuration version="37">
+    <folder id="default" label="Default Folder" path="/home/user/Sync" type="sendreceive"></folder>
+    <gui enabled="true" tls="false" debugging="false">
+        <address>127.0.0.1:8384</address>
+        <apikey>abcdefGHIJ</apikey>
+        <theme>default</theme>
+    </gui>
+</configuration>`
+	if err := os.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	key, err := configXmlKey(path).apiKey()
+	if err != nil || key != "abcdefGHIJ" {
+		t.Errorf("got %q, %v, want abcdefGHIJ", key, err)
+	}
+
+	if key, err := configXmlKey("").apiKey(); key != "" || err != nil {
+		t.Errorf("got %q, %v without config.xml", key, err)
+	}
+
+	if err := os.WriteFile(path, []byte("<configuration><gui>"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := configXmlKey(path).apiKey(); err == nil {
+		t.Error("no error for a broken config.xml")
+	}
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// headerList collects the repeatable -header flag
+type headerList []string
+
+func (h *headerList) String() string {
+	return strings.Join(*h, ", ")
+}
+
+func (h *headerList) Set(v string) error {
+	name, _, ok := strings.Cut(v, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return fmt.Errorf("header must be given as \"Name: value\"")
+	}
+	*h = append(*h, v)
+	return nil
+}
+
+// without an api key the GUI only accepts requests that send back the csrf
+// token it has set as cookie
+func needsCSRF() bool {
+	return config.ApiKey == ""
+}
+
+// csrfToken returns the name of the header and the token to send with it
+func csrfToken(jar http.CookieJar, u *url.URL) (string, string) {
+	if jar == nil {
+		return "", ""
+	}
+	for _, c := range jar.Cookies(u) {
+		if strings.HasPrefix(c.Name, "CSRF-Token-") {
+			return "X-" + c.Name, c.Value
+		}
+	}
+	return "", ""
+}
+
+// authorize adds the credentials and the extra headers to a request, the
+// extra headers come last so they can replace the others
+func authorize(req *http.Request, jar http.CookieJar) {
+	if config.ApiKey != "" {
+		req.Header.Set("X-API-Key", config.ApiKey)
+	}
+	if config.user != "" {
+		req.SetBasicAuth(config.user, config.password)
+	}
+	if name, token := csrfToken(jar, req.URL); name != "" {
+		req.Header.Set(name, token)
+	}
+	for _, h := range config.headers {
+		name, value, _ := strings.Cut(h, ":")
+		req.Header.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+	}
+}
+
+// fetchCSRFToken loads the GUI which sets the session and csrf cookies
+func fetchCSRFToken(ctx context.Context, client *http.Client) error {
+	slog.Debug("getting csrf token")
+	req, err := http.NewRequestWithContext(ctx, "GET", config.Url+"/", nil)
+	if err != nil {
+		return err
+	}
+	authorize(req, client.Jar)
+
+	response, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	closeBody(response.Body)
+
+	if response.StatusCode == 401 {
+		return errUnauthorized
+	}
+	if _, token := csrfToken(client.Jar, req.URL); token == "" {
+		return fmt.Errorf("no csrf token received from %s (%s)", config.target, response.Status)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// barDisplay writes the state as one line per change for status bars
+// like waybar, i3bar or polybar
+type barDisplay struct {
+	mu       sync.Mutex
+	format   string
+	version  string
+	err      error
+	status   syncStatus
+	in       float64
+	out      float64
+	conn     connState
+	retry    time.Time
+	lastLine string
+}
+
+func (b *barDisplay) showVersion(version string) {
+	b.mu.Lock()
+	b.version = version
+	b.err = nil
+	b.print()
+	b.mu.Unlock()
+}
+
+func (b *barDisplay) showError(err error) {
+	b.mu.Lock()
+	b.err = err
+	b.print()
+	b.mu.Unlock()
+}
+
+func (b *barDisplay) showStatus(status syncStatus) {
+	b.mu.Lock()
+	b.status = status
+	b.print()
+	b.mu.Unlock()
+}
+
+func (b *barDisplay) showRates(in, out float64) {
+	b.mu.Lock()
+	b.in, b.out = in, out
+	b.print()
+	b.mu.Unlock()
+}
+
+var barColors = map[string]string{
+	"error":        "#ff4136",
+	"disconnected": "#aaaaaa",
+	"downloading":  "#0074d9",
+	"uploading":    "#0074d9",
+	"syncing":      "#0074d9",
+}
+
+func (b *barDisplay) showConnection(state connState, nextRetry time.Time) {
+	b.mu.Lock()
+	b.conn, b.retry = state, nextRetry
+	b.print()
+	b.mu.Unlock()
+}
+
+// print writes a line if anything shown has changed, needs b.mu
+func (b *barDisplay) print() {
+	state := b.status.name()
+	text := "↓" + formatRateCompact(b.in) + " ↑" + formatRateCompact(b.out)
+	tooltip := fmt.Sprintf("Syncthing %s\nConnected to %d Devices\n↓: %s ↑: %s", b.version, b.status.Connected, formatRate(b.in), formatRate(b.out))
+	if b.err != nil {
+		class := classifyError(b.err)
+		state = "error"
+		if class.stopped() {
+			state = "disconnected"
+		}
+		text = "syncthing: " + strings.ReplaceAll(class.String(), "-", " ")
+		tooltip = fmt.Sprintf("%s: %s\n%s\nHint: %s", class.message(), config.target, b.err, class.hint())
+		if b.conn == stateBackoff {
+			tooltip += "\nretrying at " + b.retry.Format(time.TimeOnly)
+		}
+	} else if state == "disconnected" {
+		text = "syncthing: disconnected"
+	}
+
+	var line []byte
+	switch b.format {
+	case "waybar":
+		line, _ = json.Marshal(map[string]interface{}{
+			"text":       text,
+			"tooltip":    tooltip,
+			"class":      state,
+			"percentage": int(b.status.Completion),
+		})
+	case "i3bar":
+		block := map[string]string{"name": "syncthing", "full_text": text}
+		if color, ok := barColors[state]; ok {
+			block["color"] = color
+		}
+		line, _ = json.Marshal([]interface{}{block})
+		line = append([]byte{','}, line...)
+	default:
+		line = []byte(text)
+	}
+
+	if string(line) != b.lastLine {
+		b.lastLine = string(line)
+		fmt.Fprintf(os.Stdout, "%s\n", line)
+	}
+}
+
+// runBar follows syncthing without a tray and prints status bar lines
+func runBar(format string) {
+	if format == "i3bar" {
+		// an endless array of status lines, the first one is empty so
+		// that every following line can start with a comma
+		fmt.Fprintln(os.Stdout, `{"version":1}`)
+		fmt.Fprintln(os.Stdout, "[")
+		fmt.Fprintln(os.Stdout, "[]")
+	}
+
+	b := &barDisplay{format: format}
+	b.mu.Lock()
+	b.print()
+	b.mu.Unlock()
+	ui = b
+	startMonitor()
+	waitForShutdown()
+}
@@ -0,0 +1,435 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// exit codes of the commands, status uses them to report the sync state
+const (
+	exitSynced       = 0
+	exitSyncing      = 1
+	exitDisconnected = 2
+	exitError        = 3
+)
+
+// commands that can be given as first argument instead of starting the tray
+var commands = map[string]func(args []string) int{
+	"status": statusCommand,
+	"daemon": daemonCommand,
+	"wait":   waitCommand,
+	"pause": func(args []string) int {
+		return deviceCommand("pause", args)
+	},
+	"resume": func(args []string) int {
+		return deviceCommand("resume", args)
+	},
+	"scan":    scanCommand,
+	"restart": restartCommand,
+	"open":    openCommand,
+	"file":    fileCommand,
+}
+
+// newCommandFlags creates the flags for a command including the connection
+// options
+func newCommandFlags(name, usage string) *flag.FlagSet {
+	fs := flag.NewFlagSet(name, flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s\n", os.Args[0], usage)
+		fs.PrintDefaults()
+	}
+	addConfigFlags(fs)
+	return fs
+}
+
+// parseCommandFlags returns false if the command should exit with exitError
+func parseCommandFlags(fs *flag.FlagSet, args []string) bool {
+	if err := parseFlags(fs, args); err != nil {
+		return false
+	}
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == "target" {
+			config.targetGiven = true
+		}
+	})
+	if err := checkConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	// the log would mix with the output, it is only shown with -v
+	var w io.Writer = ioutil.Discard
+	if config.verbose {
+		w = os.Stderr
+	}
+	if err := setupLogging(w); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return false
+	}
+	return true
+}
+
+func statusCommand(args []string) int {
+	fs := newCommandFlags("status", "status [options]")
+	jsonOutput := fs.Bool("json", false, "print the status as JSON")
+	if !parseCommandFlags(fs, args) {
+		return exitError
+	}
+
+	err := loadState()
+	report := buildReport()
+	if err != nil {
+		report.setError(err.Error(), classifyError(err))
+	}
+
+	if *jsonOutput {
+		writeJSON(os.Stdout, report)
+	} else {
+		printReport(report)
+	}
+
+	switch report.State {
+	case "idle":
+		return exitSynced
+	case "disconnected":
+		return exitDisconnected
+	case "error":
+		return exitError
+	}
+	return exitSyncing
+}
+
+// daemonCommand follows syncthing like the tray does and logs state changes
+func daemonCommand(args []string) int {
+	fs := newCommandFlags("daemon", "daemon [options]")
+	// unlike the other commands the log is the output
+	if parseFlags(fs, args) != nil {
+		return exitError
+	}
+	if err := checkConfig(); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if err := setupLogging(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	slog.Info("Starting Syncthing-Tray daemon", "version", VersionStr)
+	slog.Info("Connecting to syncthing", "target", config.target)
+	startMonitor()
+	waitForShutdown()
+	return exitSynced
+}
+
+// waitCommand blocks until folders are synced, locally and optionally with
+// a device
+func waitCommand(args []string) int {
+	fs := newCommandFlags("wait", "wait [options]")
+	folderId := fs.String("folder", "", "only wait for this folder")
+	deviceId := fs.String("device", "", "also wait until the folders are synced to this device")
+	timeout := fs.Duration("timeout", 0, "give up after this time, 0 waits forever")
+	if !parseCommandFlags(fs, args) {
+		return exitError
+	}
+
+	var deadline <-chan time.Time
+	if *timeout > 0 {
+		deadline = time.After(*timeout)
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	followSyncthing()
+	for {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			fmt.Println("not synced after", *timeout)
+			mutex.Lock()
+			remaining, _ := outstanding(*folderId, *deviceId)
+			mutex.Unlock()
+			for _, r := range remaining {
+				fmt.Println(" ", r)
+			}
+			dataMutex.Lock()
+			if connectionError != "" {
+				fmt.Println("  last error:", connectionError)
+				fmt.Println("  hint:", connectionErrorClass.hint())
+			}
+			dataMutex.Unlock()
+			return exitSyncing
+		}
+
+		// waiting can not help if the login or the certificate is wrong
+		dataMutex.Lock()
+		lastError, class := connectionError, connectionErrorClass
+		dataMutex.Unlock()
+		if lastError != "" && class.needsSetup() {
+			fmt.Fprintln(os.Stderr, lastError)
+			fmt.Fprintln(os.Stderr, "hint:", class.hint())
+			return exitError
+		}
+
+		mutex.Lock()
+		remaining, err := outstanding(*folderId, *deviceId)
+		mutex.Unlock()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		if len(remaining) == 0 {
+			fmt.Println("synced")
+			return exitSynced
+		}
+	}
+}
+
+// outstanding lists what still needs to be synced, needs mutex
+func outstanding(folderId, deviceId string) ([]string, error) {
+	if folder == nil {
+		return []string{"waiting for syncthing"}, nil
+	}
+	if _, ok := folder[folderId]; folderId != "" && !ok {
+		return nil, fmt.Errorf("unknown folder %s", folderId)
+	}
+	d, ok := device[deviceId]
+	if deviceId != "" && !ok {
+		return nil, fmt.Errorf("unknown device %s", deviceId)
+	}
+
+	var remaining []string
+	for id, f := range folder {
+		if folderId != "" && id != folderId {
+			continue
+		}
+
+		var completion float64
+		if d != nil {
+			var shared bool
+			completion, shared = d.folderCompletion[id]
+			if !shared {
+				if folderId != "" {
+					return nil, fmt.Errorf("folder %s is not shared with device %s", folderId, deviceId)
+				}
+				continue
+			}
+		}
+
+		if f.completion < 0 {
+			remaining = append(remaining, fmt.Sprintf("folder %s: state unknown", id))
+		} else if f.completion < 100 || f.state != "idle" {
+			remaining = append(remaining, fmt.Sprintf("folder %s: %s, %.2f%%, %d files needed", id, f.state, f.completion, f.needFiles))
+		}
+
+		if d != nil {
+			if !d.connected {
+				remaining = append(remaining, fmt.Sprintf("folder %s: device %s is not connected", id, d.name))
+			} else if completion < 0 {
+				remaining = append(remaining, fmt.Sprintf("folder %s: completion on device %s unknown", id, d.name))
+			} else if completion < 100 {
+				remaining = append(remaining, fmt.Sprintf("folder %s: %.2f%% on device %s", id, completion, d.name))
+			}
+		}
+	}
+	sort.Strings(remaining)
+	return remaining, nil
+}
+
+// runControl sends a command through a running tray or, if there is none,
+// directly to syncthing. prepare is only called in the latter case.
+func runControl(name string, params url.Values, prepare func() error) int {
+	sent, err := sendControl(name, params)
+	if !sent {
+		err = prepare()
+		if err == nil {
+			err = controlCommands[name](params)
+		}
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	return exitSynced
+}
+
+func noPrepare() error {
+	return nil
+}
+
+// deviceCommand pauses or resumes one or all devices
+func deviceCommand(name string, args []string) int {
+	fs := newCommandFlags(name, name+" [options]")
+	deviceId := fs.String("device", "", "only "+name+" this device")
+	if !parseCommandFlags(fs, args) {
+		return exitError
+	}
+
+	params := url.Values{}
+	if *deviceId != "" {
+		params.Set("device", *deviceId)
+	}
+	return runControl(name, params, noPrepare)
+}
+
+// scanCommand rescans a folder, a path inside it or the folder containing
+// a local path
+func scanCommand(args []string) int {
+	fs := newCommandFlags("scan", "scan [options] -folder ID | path")
+	folderId := fs.String("folder", "", "folder to rescan")
+	sub := fs.String("sub", "", "only rescan this path inside the folder")
+	if !parseCommandFlags(fs, args) {
+		return exitError
+	}
+
+	params := url.Values{}
+	if *folderId != "" {
+		params.Set("folder", *folderId)
+		if *sub != "" {
+			params.Set("sub", *sub)
+		}
+	} else if fs.NArg() == 1 {
+		// a running tray has a different working directory
+		path, err := filepath.Abs(fs.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			return exitError
+		}
+		params.Set("path", path)
+	} else {
+		fs.Usage()
+		return exitError
+	}
+
+	return runControl("scan", params, func() error {
+		if params.Get("path") == "" {
+			return nil
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		return get_config()
+	})
+}
+
+// fileCommand shows the state of a local file in its syncthing folder
+func fileCommand(args []string) int {
+	fs := newCommandFlags("file", "file [options] [-folder ID] path")
+	jsonOutput := fs.Bool("json", false, "print the file info as JSON")
+	folderId := fs.String("folder", "", "the path is inside this folder instead of a local path")
+	if !parseCommandFlags(fs, args) {
+		return exitError
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitError
+	}
+
+	mutex.Lock()
+	err := get_config()
+	mutex.Unlock()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+
+	report, err := getFileReport(*folderId, fs.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return exitError
+	}
+	if *jsonOutput {
+		writeJSON(os.Stdout, report)
+	} else {
+		printFileReport(report)
+	}
+
+	if !report.InSync {
+		return exitSyncing
+	}
+	return exitSynced
+}
+
+func restartCommand(args []string) int {
+	fs := newCommandFlags("restart", "restart [options]")
+	if !parseCommandFlags(fs, args) {
+		return exitError
+	}
+
+	return runControl("restart", url.Values{}, noPrepare)
+}
+
+// openCommand opens the GUI, optionally at a folder or device
+func openCommand(args []string) int {
+	fs := newCommandFlags("open", "open [options] [folder or device ID]")
+	if !parseCommandFlags(fs, args) {
+		return exitError
+	}
+
+	params := url.Values{}
+	if fs.NArg() > 0 {
+		params.Set("id", fs.Arg(0))
+	}
+	// the config is needed to tell folders from devices
+	return runControl("open", params, func() error {
+		if fs.NArg() == 0 {
+			return nil
+		}
+		mutex.Lock()
+		defer mutex.Unlock()
+		return get_config()
+	})
+}
+
+func printReport(report statusReport) {
+	if report.Error != "" {
+		fmt.Printf("Syncthing at %s: %s\n", report.Target, report.Error)
+		if report.Hint != "" {
+			fmt.Printf("Hint: %s\n", report.Hint)
+		}
+		return
+	}
+	fmt.Printf("Syncthing %s at %s: %s\n", report.Version, report.Target, report.State)
+	fmt.Printf("Connected to %d of %d devices\n", report.Connected, len(report.Devices))
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "\nFolder\tState\tCompletion\t")
+	for _, f := range report.Folders {
+		need := ""
+		if f.NeedFiles > 0 {
+			need = fmt.Sprintf("%d files needed", f.NeedFiles)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%.2f%%\t%s\n", f.ID, f.State, f.Completion, need)
+	}
+
+	fmt.Fprintln(w, "\nDevice\tState\tOut of sync\t")
+	for _, d := range report.Devices {
+		state := "disconnected"
+		if d.Connected {
+			state = "connected"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t\n", d.Name, state, outOfSync(d.Completion))
+	}
+	w.Flush()
+}
+
+// outOfSync lists the folders that are not completely synced to a device
+func outOfSync(completion map[string]float64) string {
+	var folders []string
+	for id, c := range completion {
+		if c >= 0 && c < 100 {
+			folders = append(folders, fmt.Sprintf("%s (%.2f%%)", id, c))
+		}
+	}
+	sort.Strings(folders)
+	return strings.Join(folders, ", ")
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// configFilePath is the optional file with default options, e.g.
+// ~/.config/syncthing-tray/config
+func configFilePath() string {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "syncthing-tray", "config")
+}
+
+// parseFlags sets the options from the config file and then from the
+// command line, which wins
+func parseFlags(fs *flag.FlagSet, args []string) error {
+	if err := loadConfigFile(fs, configFilePath()); err != nil {
+		fmt.Fprintln(fs.Output(), err)
+		return err
+	}
+	return fs.Parse(args)
+}
+
+// loadConfigFile reads one option per line as "name = value", the names
+// are those of the flags. empty lines and lines starting with # are skipped.
+// the tray and every command read the same file, so options that fs does
+// not have, e.g. bar for a command or json for the tray, are skipped too.
+func loadConfigFile(fs *flag.FlagSet, path string) error {
+	if path == "" {
+		return nil
+	}
+	f, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		name, value, found := strings.Cut(text, "=")
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+		if !found || name == "" {
+			return fmt.Errorf("%s:%d: expected name = value", path, line)
+		}
+		if fs.Lookup(name) == nil {
+			continue
+		}
+		if err := fs.Set(name, value); err != nil {
+			return fmt.Errorf("%s:%d: invalid value for %s: %v", path, line, name, err)
+		}
+	}
+	return scanner.Err()
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestLoadConfigFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config")
+	data := "# shared by the tray and the commands\ntarget = https://nas:8384\n\nbar = plain\njson = true\n"
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	tray := flag.NewFlagSet("tray", flag.ContinueOnError)
+	trayTarget := tray.String("target", "", "")
+	bar := tray.String("bar", "", "")
+	if err := loadConfigFile(tray, path); err != nil {
+		t.Fatalf("tray: %v", err)
+	}
+	if *trayTarget != "https://nas:8384" || *bar != "plain" {
+		t.Errorf("tray: got target %q and bar %q", *trayTarget, *bar)
+	}
+
+	status := flag.NewFlagSet("status", flag.ContinueOnError)
+	statusTarget := status.String("target", "", "")
+	json := status.Bool("json", false, "")
+	if err := loadConfigFile(status, path); err != nil {
+		t.Fatalf("status: %v", err)
+	}
+	if *statusTarget != "https://nas:8384" || !*json {
+		t.Errorf("status: got target %q and json %v", *statusTarget, *json)
+	}
+}
+
+func TestLoadConfigFileErrors(t *testing.T) {
+	cases := []struct {
+		name, data, err string
+	}{
+		{"no value", "target\n", ":1: expected name = value"},
+		{"invalid value", "# comment\njson = maybe\n", ":2: invalid value for json"},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "config")
+			if err := ioutil.WriteFile(path, []byte(c.data), 0600); err != nil {
+				t.Fatal(err)
+			}
+			fs := flag.NewFlagSet("status", flag.ContinueOnError)
+			fs.String("target", "", "")
+			fs.Bool("json", false, "")
+			err := loadConfigFile(fs, path)
+			if err == nil || !strings.Contains(err.Error(), path+c.err) {
+				t.Errorf("got %v, want %s%s", err, path, c.err)
+			}
+		})
+	}
+}
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"log/slog"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// connState is the state of the connection to syncthing
+type connState int
+
+const (
+	stateDisconnected connState = iota
+	stateConnecting             // reading config
+	stateInitialising           // reading folder and device state
+	stateLive                   // following events
+	stateBackoff                // waiting for the next attempt after an error
+)
+
+var connStateNames = []string{"disconnected", "connecting", "initialising", "live", "backoff"}
+
+func (s connState) String() string {
+	return connStateNames[s]
+}
+
+const minRetryDelay = time.Second
+
+// connection state, guarded by connMutex
+var connMutex = &sync.Mutex{}
+var connChanged = sync.NewCond(connMutex)
+var connection struct {
+	state     connState
+	nextRetry time.Time
+}
+
+// reinitPending is set when the config changed while initializeLocked was
+// already reading it, guarded by connMutex
+var reinitPending bool
+
+// failedPolls counts the event polls that failed in a row, guarded by
+// connMutex. only a successful poll resets it, connecting again does not.
+var failedPolls int
+
+// retryNow ends the current backoff early
+var retryNow = make(chan struct{}, 1)
+
+func setConnState(state connState, nextRetry time.Time) {
+	connMutex.Lock()
+	prev := switchConnState(state, nextRetry)
+	connMutex.Unlock()
+	showConnState(prev, state, nextRetry)
+}
+
+// switchConnState needs connMutex and returns the previous state
+func switchConnState(state connState, nextRetry time.Time) connState {
+	if state == stateConnecting {
+		reinitPending = false // the config is read from now on
+	}
+	prev := connection.state
+	connection.state = state
+	connection.nextRetry = nextRetry
+	connChanged.Broadcast()
+	return prev
+}
+
+func showConnState(prev, state connState, nextRetry time.Time) {
+	if state == stateBackoff {
+		slog.Info("connection state", "from", prev, "to", state, "nextRetry", nextRetry.Format(time.TimeOnly))
+	} else {
+		slog.Info("connection state", "from", prev, "to", state)
+	}
+	ui.showConnection(state, nextRetry)
+}
+
+func getConnState() (connState, time.Time) {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+	return connection.state, connection.nextRetry
+}
+
+// startConnecting switches to connecting unless an attempt is already
+// running, only one initializeLocked may run at a time. a running attempt
+// that already started reading the config reads it again. in backoff the
+// next attempt reads it anyway.
+func startConnecting() bool {
+	connMutex.Lock()
+	switch connection.state {
+	case stateConnecting, stateInitialising:
+		reinitPending = true
+		connMutex.Unlock()
+		return false
+	case stateBackoff:
+		connMutex.Unlock()
+		return false
+	}
+	prev := switchConnState(stateConnecting, time.Time{})
+	connMutex.Unlock()
+	showConnState(prev, stateConnecting, time.Time{})
+	return true
+}
+
+// finishConnecting switches to live, unless the config changed in the
+// meantime and has to be read again
+func finishConnecting() bool {
+	connMutex.Lock()
+	if reinitPending {
+		reinitPending = false
+		connMutex.Unlock()
+		return false
+	}
+	prev := switchConnState(stateLive, time.Time{})
+	connMutex.Unlock()
+	showConnState(prev, stateLive, time.Time{})
+	return true
+}
+
+// waitForConnState blocks until the connection is in one of the states
+func waitForConnState(states ...connState) {
+	connMutex.Lock()
+	defer connMutex.Unlock()
+	for {
+		for _, s := range states {
+			if connection.state == s {
+				return
+			}
+		}
+		connChanged.Wait()
+	}
+}
+
+// waitBackoff shows the next retry and waits for it, nothing may be locked
+func waitBackoff(delay time.Duration) {
+	setConnState(stateBackoff, time.Now().Add(delay))
+	select {
+	case <-time.After(delay):
+	case <-retryNow:
+		slog.Info("retrying now")
+	}
+}
+
+// triggerRetry skips the remaining backoff
+func triggerRetry() {
+	select {
+	case retryNow <- struct{}{}:
+	default:
+	}
+}
+
+// backoffDelay grows exponentially with the number of failed attempts up to
+// config.maxRetryDelay, with up to 25% jitter in both directions so that
+// several trays do not hit a restarted syncthing at the same time
+func backoffDelay(attempt int) time.Duration {
+	delay := config.maxRetryDelay
+	if attempt < 32 && minRetryDelay<<uint(attempt) < config.maxRetryDelay {
+		delay = minRetryDelay << uint(attempt)
+	}
+	jitter := time.Duration(rand.Int63n(int64(delay)/2+1)) - delay/4
+	delay += jitter
+	if delay > config.maxRetryDelay {
+		delay = config.maxRetryDelay
+	}
+	return delay
+}
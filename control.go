@@ -0,0 +1,346 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/toqueteos/webbrowser"
+)
+
+type folderReport struct {
+	ID         string  `json:"id"`
+	State      string  `json:"state"`
+	Completion float64 `json:"completion"`
+	NeedFiles  int     `json:"needFiles"`
+}
+
+type deviceReport struct {
+	ID         string             `json:"id"`
+	Name       string             `json:"name"`
+	Connected  bool               `json:"connected"`
+	Completion map[string]float64 `json:"completion"`
+}
+
+type rateReport struct {
+	In  float64 `json:"in"`
+	Out float64 `json:"out"`
+}
+
+// statusReport is everything the tray knows about syncthing
+type statusReport struct {
+	State      string     `json:"state"`
+	Error      string     `json:"error,omitempty"`
+	ErrorClass string     `json:"errorClass,omitempty"`
+	Hint       string     `json:"hint,omitempty"`
+	Connection string     `json:"connection"`
+	NextRetry  *time.Time `json:"nextRetry,omitempty"`
+	Target     string     `json:"target"`
+	Version    string     `json:"version"`
+	syncStatus
+	Rates   rateReport     `json:"rates"`
+	Folders []folderReport `json:"folders"`
+	Devices []deviceReport `json:"devices"`
+}
+
+func buildReport() statusReport {
+	report := statusReport{
+		Target:  config.target,
+		Folders: make([]folderReport, 0),
+		Devices: make([]deviceReport, 0),
+	}
+
+	state, nextRetry := getConnState()
+	report.Connection = state.String()
+	if state == stateBackoff {
+		report.NextRetry = &nextRetry
+	}
+
+	mutex.Lock()
+	report.syncStatus = currentStatus()
+	report.State = report.syncStatus.name()
+	for id, f := range folder {
+		report.Folders = append(report.Folders, folderReport{id, f.state, f.completion, f.needFiles})
+	}
+	for id, d := range device {
+		completion := make(map[string]float64)
+		for folderId, c := range d.folderCompletion {
+			completion[folderId] = c
+		}
+		report.Devices = append(report.Devices, deviceReport{id, d.name, d.connected, completion})
+	}
+	mutex.Unlock()
+
+	sort.Slice(report.Folders, func(i, j int) bool { return report.Folders[i].ID < report.Folders[j].ID })
+	sort.Slice(report.Devices, func(i, j int) bool { return report.Devices[i].ID < report.Devices[j].ID })
+
+	dataMutex.Lock()
+	report.Version = syncthingVersion
+	report.Rates = rateReport{inBytesRate, outBytesRate}
+	if connectionError != "" {
+		report.setError(connectionError, connectionErrorClass)
+	}
+	dataMutex.Unlock()
+
+	return report
+}
+
+func (r *statusReport) setError(err string, class errorClass) {
+	r.State = "error"
+	r.Error = err
+	r.ErrorClass = class.String()
+	r.Hint = class.hint()
+}
+
+// defaultControlSocket is in $XDG_RUNTIME_DIR which is only accessible by
+// the user, otherwise in a directory of the user in the temp dir
+func defaultControlSocket() string {
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+		return filepath.Join(dir, "syncthing-tray.sock")
+	}
+	return filepath.Join(os.TempDir(), fmt.Sprintf("syncthing-tray-%d", os.Getuid()), "control.sock")
+}
+
+// checkSocket refuses a control socket that another user may have created
+// to receive the commands, the directory has to belong to the user or root
+func checkSocket(path string) error {
+	uid := os.Getuid()
+	if info, err := os.Lstat(filepath.Dir(path)); err == nil {
+		if owner := fileOwner(info); owner != uid && owner != 0 {
+			return fmt.Errorf("directory of control socket %s belongs to another user", path)
+		}
+	}
+	if info, err := os.Lstat(path); err == nil && fileOwner(info) != uid {
+		return fmt.Errorf("control socket %s belongs to another user", path)
+	}
+	return nil
+}
+
+// controlCommands are forwarded to syncthing, they are used by the control
+// api and by the commands of the same name
+var controlCommands = map[string]func(params url.Values) error{
+	"open": func(params url.Values) error {
+		return openGui(params.Get("id"))
+	},
+	"scan": func(params url.Values) error {
+		if params.Get("folder") == "" && params.Get("path") != "" {
+			mutex.Lock()
+			f, rel, err := folderForPath(params.Get("path"))
+			mutex.Unlock()
+			if err != nil {
+				return err
+			}
+			params.Set("folder", f.id)
+			params.Set("sub", rel)
+		}
+		if params.Get("folder") == "" {
+			return fmt.Errorf("missing folder")
+		}
+		return post_syncthing(config.Url + "/rest/db/scan?" + forwardParams(params, "folder", "sub"))
+	},
+	"pause": func(params url.Values) error {
+		return post_syncthing(config.Url + "/rest/system/pause?" + forwardParams(params, "device"))
+	},
+	"resume": func(params url.Values) error {
+		return post_syncthing(config.Url + "/rest/system/resume?" + forwardParams(params, "device"))
+	},
+	"restart": func(params url.Values) error {
+		return post_syncthing(config.Url + "/rest/system/restart")
+	},
+}
+
+// openGui opens the GUI in the browser, the id of a folder or device is
+// passed as fragment of the url
+func openGui(id string) error {
+	target := guiUrl()
+	if target == "" {
+		return fmt.Errorf("the GUI of %s can not be opened in a browser, set -gui-url or -ssh-gui-port or open it from a running tray", config.target)
+	}
+	if id != "" {
+		mutex.Lock()
+		_, isFolder := folder[id]
+		_, isDevice := device[id]
+		mutex.Unlock()
+
+		if isFolder {
+			target += "/#folder-" + url.PathEscape(id)
+		} else if isDevice {
+			target += "/#device-" + url.PathEscape(id)
+		} else {
+			return fmt.Errorf("unknown folder or device %s", id)
+		}
+	}
+	return webbrowser.Open(target)
+}
+
+// controlListener is set by serveControl and closed on shutdown, guarded
+// by controlMutex
+var controlMutex = &sync.Mutex{}
+var controlListener net.Listener
+
+func serveControl(path string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		slog.Error("could not create directory of control socket", "err", err)
+		return
+	}
+	if err := checkSocket(path); err != nil {
+		slog.Error("not serving control api", "err", err)
+		return
+	}
+	if conn, err := net.Dial("unix", path); err == nil {
+		conn.Close()
+		slog.Warn("another instance is serving the control socket", "path", path)
+		return
+	}
+	os.Remove(path) // left over from an instance that did not shut down cleanly
+
+	// access to the api is only restricted by the permissions of the socket
+	l, err := listenPrivate(path)
+	if err != nil {
+		slog.Error("could not create control socket", "err", err)
+		return
+	}
+	controlMutex.Lock()
+	controlListener = l
+	controlMutex.Unlock()
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, buildReport())
+	})
+	mux.HandleFunc("/folders", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, buildReport().Folders)
+	})
+	mux.HandleFunc("/devices", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, buildReport().Devices)
+	})
+	mux.HandleFunc("/rates", func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, buildReport().Rates)
+	})
+	for name, cmd := range controlCommands {
+		mux.HandleFunc("/"+name, controlCommand(cmd))
+	}
+
+	slog.Info("serving control api", "path", path)
+	err = http.Serve(l, mux)
+	slog.Debug("control api stopped", "err", err)
+}
+
+// controlClient talks to the control api of a running tray
+var controlClient = &http.Client{
+	Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", config.controlSocket)
+		},
+	},
+}
+
+// sendControl runs a command through a running tray, sent is false if no
+// tray is listening on the control socket or the tray is connected to
+// another syncthing than the one given with -target
+func sendControl(name string, params url.Values) (sent bool, err error) {
+	if config.controlSocket == "" {
+		return false, nil
+	}
+	if _, err := os.Stat(config.controlSocket); err != nil {
+		return false, nil
+	}
+	if err := checkSocket(config.controlSocket); err != nil {
+		return true, err
+	}
+
+	query := url.Values{}
+	for k, v := range params {
+		query[k] = v
+	}
+	if config.targetGiven {
+		query.Set("target", config.target)
+	}
+	resp, err := controlClient.Post("http://syncthing-tray/"+name+"?"+query.Encode(), "", nil)
+	if err != nil {
+		var opErr *net.OpError
+		if errors.As(err, &opErr) && opErr.Op == "dial" {
+			return false, nil // nobody listening, the socket is left over
+		}
+		return true, err
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode == http.StatusConflict {
+		slog.Debug("not using the tray", "reason", strings.TrimSpace(string(body)))
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return true, fmt.Errorf("%s", strings.TrimSpace(string(body)))
+	}
+	return true, nil
+}
+
+// sameTarget compares targets as given, a trailing slash does not matter
+func sameTarget(a, b string) bool {
+	return strings.TrimSuffix(a, "/") == strings.TrimSuffix(b, "/")
+}
+
+func stopControl() {
+	controlMutex.Lock()
+	if controlListener != nil {
+		controlListener.Close() // also removes the socket file
+	}
+	controlMutex.Unlock()
+}
+
+// forwardParams encodes the given parameters if they are set
+func forwardParams(params url.Values, names ...string) string {
+	forward := url.Values{}
+	for _, name := range names {
+		if value := params.Get(name); value != "" {
+			forward.Set(name, value)
+		}
+	}
+	return forward.Encode()
+}
+
+func writeJSON(w io.Writer, v interface{}) {
+	if rw, ok := w.(http.ResponseWriter); ok {
+		rw.Header().Set("Content-Type", "application/json")
+	}
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// controlCommand wraps a command that is forwarded to syncthing, commands
+// must be sent with POST and get their parameters from the query string
+func controlCommand(cmd func(params url.Values) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		// commands for another syncthing are sent there directly
+		if target := r.URL.Query().Get("target"); target != "" && !sameTarget(target, config.target) {
+			http.Error(w, "the tray is connected to "+config.target, http.StatusConflict)
+			return
+		}
+		if err := cmd(r.URL.Query()); err != nil {
+			slog.Warn("control command failed", "command", r.URL.Path, "err", err)
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		writeJSON(w, map[string]string{"result": "ok"})
+	}
+}
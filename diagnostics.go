@@ -0,0 +1,169 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how many errors are kept for the diagnostics
+const errorHistorySize = 10
+
+type errorRecord struct {
+	at    time.Time
+	class errorClass
+	err   string
+}
+
+func (e errorRecord) String() string {
+	return fmt.Sprintf("%s %s: %s", e.at.Format(time.DateTime), e.class, e.err)
+}
+
+// last errors, newest first, and the delay of the last event that was sent
+// while polling, guarded by dataMutex
+var errorHistory []errorRecord
+var eventLatency time.Duration
+
+// recordError needs dataMutex
+func recordError(err error, class errorClass) {
+	errorHistory = append([]errorRecord{{time.Now(), class, err.Error()}}, errorHistory...)
+	if len(errorHistory) > errorHistorySize {
+		errorHistory = errorHistory[:errorHistorySize]
+	}
+}
+
+func buildDate() string {
+	buildInt, _ := strconv.Atoi(BuildUnixTime)
+	return time.Unix(int64(buildInt), 0).UTC().Format("2006-01-02 15:04:05 MST")
+}
+
+// diagnostics is a snapshot of everything useful for a bug report
+type diagnostics struct {
+	connection string
+	version    string
+	uptime     time.Duration // zero if unknown
+	lastPoll   time.Time
+	latency    time.Duration
+	reconnects int
+	errors     []errorRecord
+}
+
+func getDiagnostics() diagnostics {
+	var d diagnostics
+	state, nextRetry := getConnState()
+	d.connection = state.String()
+	if state == stateBackoff {
+		d.connection += ", retrying at " + nextRetry.Format(time.TimeOnly)
+	}
+
+	mutex.Lock()
+	if started, err := time.Parse(time.RFC3339, startTime); err == nil {
+		d.uptime = time.Since(started)
+	}
+	mutex.Unlock()
+
+	dataMutex.Lock()
+	d.version = syncthingVersion
+	d.lastPoll = lastEventPoll
+	d.latency = eventLatency
+	d.reconnects = reconnects
+	d.errors = append(d.errors, errorHistory...)
+	dataMutex.Unlock()
+	return d
+}
+
+// syncthingText is the version and uptime of syncthing for the menu
+func (d diagnostics) syncthingText() string {
+	if d.version == "" {
+		return "Syncthing: not connected yet"
+	}
+	text := "Syncthing " + d.version
+	if d.uptime > 0 {
+		text += ", up " + formatUptime(d.uptime)
+	}
+	return text
+}
+
+func (d diagnostics) pollText() string {
+	if d.lastPoll.IsZero() {
+		return "No events received yet"
+	}
+	text := "Last event poll " + time.Since(d.lastPoll).Round(time.Second).String() + " ago"
+	if d.latency > 0 {
+		text += ", latency " + d.latency.Round(time.Millisecond).String()
+	}
+	return text
+}
+
+// report is the text copied for bug reports, secrets are replaced
+func (d diagnostics) report() string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "Syncthing-Tray %s (built %s, %s, %s/%s)\n", VersionStr, buildDate(), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Fprintf(&b, "Target: %s\n", redactUrl(config.target))
+	fmt.Fprintf(&b, "Connection: %s\n", d.connection)
+	fmt.Fprintf(&b, "%s\n", d.syncthingText())
+	fmt.Fprintf(&b, "%s\n", d.pollText())
+	fmt.Fprintf(&b, "Reconnects: %d\n", d.reconnects)
+	fmt.Fprintf(&b, "Options: %s\n", strings.Join(redactedFlags(flag.CommandLine), " "))
+	if len(d.errors) == 0 {
+		b.WriteString("No errors\n")
+	} else {
+		b.WriteString("Recent errors:\n")
+		for _, e := range d.errors {
+			fmt.Fprintf(&b, "  %s\n", e)
+		}
+	}
+	return redactSecrets(b.String())
+}
+
+// flags whose values are never shown
+var secretFlags = map[string]bool{"api": true, "password": true, "client-cert-password": true}
+
+// redactedFlags lists the flags that were set
+func redactedFlags(fs *flag.FlagSet) []string {
+	var flags []string
+	fs.Visit(func(f *flag.Flag) {
+		value := f.Value.String()
+		switch {
+		case secretFlags[f.Name]:
+			value = "[redacted]"
+		case f.Name == "header":
+			var names []string
+			for _, h := range config.headers {
+				name, _, _ := strings.Cut(h, ":")
+				names = append(names, strings.TrimSpace(name)+": [redacted]")
+			}
+			value = strings.Join(names, ", ")
+		case f.Name == "target" || f.Name == "gui-url" || f.Name == "proxy":
+			value = redactUrl(value)
+		}
+		flags = append(flags, fmt.Sprintf("-%s=%q", f.Name, value))
+	})
+	return flags
+}
+
+func redactUrl(s string) string {
+	if u, err := url.Parse(s); err == nil {
+		return u.Redacted()
+	}
+	return s
+}
+
+// redactSecrets replaces secrets that may have ended up in error messages
+func redactSecrets(s string) string {
+	secrets := []string{config.ApiKey, config.password, config.clientCertPassword}
+	for _, h := range config.headers {
+		_, value, _ := strings.Cut(h, ":")
+		secrets = append(secrets, strings.TrimSpace(value))
+	}
+	for _, secret := range secrets {
+		if secret != "" {
+			s = strings.ReplaceAll(s, secret, "[redacted]")
+		}
+	}
+	return s
+}
@@ -0,0 +1,25 @@
+package main
+
+import (
+	"time"
+)
+
+// display shows the state of syncthing, e.g. in the tray
+type display interface {
+	showVersion(version string)
+	showError(err error)
+	showStatus(status syncStatus)
+	showRates(in, out float64)
+	showConnection(state connState, nextRetry time.Time)
+}
+
+// ui is replaced by the tray once it is running, the commands leave it as is
+var ui display = noDisplay{}
+
+type noDisplay struct{}
+
+func (noDisplay) showVersion(version string)                          {}
+func (noDisplay) showError(err error)                                 {}
+func (noDisplay) showStatus(status syncStatus)                        {}
+func (noDisplay) showRates(in, out float64)                           {}
+func (noDisplay) showConnection(state connState, nextRetry time.Time) {}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+)
+
+// errorClass tells apart why syncthing can not be reached, each class has
+// its own message and hint
+type errorClass int
+
+const (
+	errorOther       errorClass = iota
+	errorNotRunning             // connection refused or no socket
+	errorUnreachable            // timeout or name lookup
+	errorTLS                    // certificate not trusted
+	errorAuth                   // api key or login rejected
+	errorServer                 // syncthing answered with 5xx
+	errorResponse               // not the json syncthing sends
+)
+
+var errorClassInfo = []struct {
+	name, message, hint string
+}{
+	errorOther:       {"error", "No connection to syncthing", "see the log for details"},
+	errorNotRunning:  {"not-running", "Syncthing is not running", "start syncthing or check -target"},
+	errorUnreachable: {"unreachable", "Syncthing can not be reached", "check the network and the address in -target"},
+	errorTLS:         {"tls", "Certificate of syncthing is not trusted", "trust it with -ca, -fingerprint or -tofu"},
+	errorAuth:        {"unauthorized", "Syncthing rejected the login", "check the API key or -user and -password"},
+	errorServer:      {"server-error", "Syncthing reported an error", "check the log of syncthing"},
+	errorResponse:    {"invalid-response", "Invalid response from syncthing", "check that -target points to the syncthing GUI"},
+}
+
+func (c errorClass) String() string {
+	return errorClassInfo[c].name
+}
+
+// message is shown in the menu instead of the version
+func (c errorClass) message() string {
+	return errorClassInfo[c].message
+}
+
+// hint tells what can be done about it
+func (c errorClass) hint() string {
+	return errorClassInfo[c].hint
+}
+
+// stopped is true if syncthing is simply not there, as opposed to problems
+// with the setup that need to be fixed
+func (c errorClass) stopped() bool {
+	return c == errorNotRunning || c == errorUnreachable
+}
+
+// needsSetup is true for errors that retrying does not fix, the login or
+// the certificate have to be changed first
+func (c errorClass) needsSetup() bool {
+	return c == errorAuth || c == errorTLS
+}
+
+func classifyError(err error) errorClass {
+	var statusErr *statusError
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	var certMismatch *certMismatchError
+	var certErr *tls.CertificateVerificationError
+	var recordErr tls.RecordHeaderError
+	var unknownAuthority x509.UnknownAuthorityError
+	var hostnameErr x509.HostnameError
+	var invalidCert x509.CertificateInvalidError
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+
+	switch {
+	case err == nil:
+		return errorOther
+	case errors.Is(err, errUnauthorized):
+		return errorAuth
+	case errors.As(err, &statusErr):
+		switch {
+		case statusErr.code == 401 || statusErr.code == 403:
+			return errorAuth
+		case statusErr.code >= 500:
+			return errorServer
+		}
+		return errorResponse
+	case errors.As(err, &certMismatch), errors.As(err, &certErr), errors.As(err, &recordErr),
+		errors.As(err, &unknownAuthority), errors.As(err, &hostnameErr), errors.As(err, &invalidCert):
+		return errorTLS
+	case refused(err), errors.Is(err, syscall.ENOENT):
+		return errorNotRunning
+	case errors.As(err, &dnsErr), errors.Is(err, context.DeadlineExceeded),
+		errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH),
+		errors.As(err, &netErr) && netErr.Timeout():
+		return errorUnreachable
+	case errors.As(err, &syntaxErr), errors.As(err, &typeErr),
+		errors.Is(err, io.ErrUnexpectedEOF), errors.Is(err, errResponseTooLarge):
+		return errorResponse
+	}
+	return errorOther
+}
+
+// refused also knows the error number of windows, it is not mapped to
+// syscall.ECONNREFUSED there
+func refused(err error) bool {
+	const wsaeconnrefused = 10061
+	var errno syscall.Errno
+	return errors.As(err, &errno) && (errno == syscall.ECONNREFUSED || errno == wsaeconnrefused)
+}
+
+// probeHealth checks that syncthing is running before anything that needs
+// authentication is requested
+func probeHealth() error {
+	var health struct {
+		Status string `json:"status"`
+	}
+	err := query_syncthing(config.Url+"/rest/noauth/health", &health)
+	var statusErr *statusError
+	if errors.As(err, &statusErr) && statusErr.code == 404 {
+		return nil // older versions do not have it
+	}
+	return err
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// expandHome resolves the ~ that syncthing allows at the start of folder paths
+func expandHome(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") || strings.HasPrefix(path, `~\`) {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, path[1:])
+		}
+	}
+	return path
+}
+
+// realPath makes a path absolute and resolves symlinks if it exists
+func realPath(path string) (string, error) {
+	path, err := filepath.Abs(expandHome(path))
+	if err != nil {
+		return "", err
+	}
+	if resolved, err := filepath.EvalSymlinks(path); err == nil {
+		return resolved, nil
+	}
+	return path, nil
+}
+
+// folderForPath finds the folder containing a local path and the path
+// relative to the folder root, needs mutex and the config to be read
+func folderForPath(path string) (*Folder, string, error) {
+	if remoteTarget() {
+		return nil, "", fmt.Errorf("the folders of %s are on another host, give the folder with -folder and the path inside it", config.target)
+	}
+	path, err := realPath(path)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var found *Folder
+	var foundRoot, foundRel string
+	for _, f := range folder {
+		root, err := realPath(f.path)
+		if err != nil {
+			continue
+		}
+		rel, err := filepath.Rel(root, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		// folders can be nested, the innermost one wins
+		if found == nil || len(root) > len(foundRoot) {
+			found, foundRoot, foundRel = f, root, rel
+		}
+	}
+
+	if found == nil {
+		return nil, "", fmt.Errorf("%s is not inside a syncthing folder", path)
+	}
+	if foundRel == "." {
+		foundRel = ""
+	}
+	return found, foundRel, nil
+}
+
+type dbFileInfo struct {
+	Name     string          `json:"name"`
+	Size     int64           `json:"size"`
+	Modified string          `json:"modified"`
+	Version  json.RawMessage `json:"version"`
+	Deleted  bool            `json:"deleted"`
+	Ignored  bool            `json:"ignored"`
+	Invalid  bool            `json:"invalid"`
+}
+
+type dbFile struct {
+	Availability json.RawMessage `json:"availability"`
+	Global       dbFileInfo      `json:"global"`
+	Local        dbFileInfo      `json:"local"`
+}
+
+// availableOn returns the devices that have the global version, older
+// syncthing versions only list the ids
+func (f dbFile) availableOn() []string {
+	var ids []string
+	if err := json.Unmarshal(f.Availability, &ids); err != nil {
+		ids = nil
+		var availability []struct {
+			ID string `json:"id"`
+		}
+		json.Unmarshal(f.Availability, &availability)
+		for _, a := range availability {
+			ids = append(ids, a.ID)
+		}
+	}
+	return ids
+}
+
+func (f dbFile) inSync() bool {
+	return bytes.Equal(compactJSON(f.Local.Version), compactJSON(f.Global.Version)) && f.Local.Deleted == f.Global.Deleted
+}
+
+func compactJSON(raw json.RawMessage) []byte {
+	var buf bytes.Buffer
+	if json.Compact(&buf, raw) != nil {
+		return raw
+	}
+	return buf.Bytes()
+}
+
+// fileReport is what the file command shows about a local file
+type fileReport struct {
+	Path      string      `json:"path"`
+	Folder    string      `json:"folder"`
+	Name      string      `json:"name"`
+	Known     bool        `json:"known"`
+	InSync    bool        `json:"inSync"`
+	Ignored   bool        `json:"ignored"`
+	Invalid   bool        `json:"invalid"`
+	Available []string    `json:"available"`
+	Local     *dbFileInfo `json:"local"`
+	Global    *dbFileInfo `json:"global"`
+}
+
+// getFileReport looks up a file in the database of its folder, either by a
+// local path or by the id of the folder and the path inside it. needs the
+// config to be read
+func getFileReport(folderId, path string) (fileReport, error) {
+	var f *Folder
+	var rel string
+	var err error
+	mutex.Lock()
+	if folderId == "" {
+		f, rel, err = folderForPath(path)
+	} else if f = folder[folderId]; f == nil {
+		err = fmt.Errorf("unknown folder %s", folderId)
+	} else {
+		rel = strings.TrimLeft(path, "/")
+	}
+	mutex.Unlock()
+	if err != nil {
+		return fileReport{}, err
+	}
+
+	report := fileReport{Path: path, Folder: f.id, Name: rel, Available: make([]string, 0)}
+	params := url.Values{"folder": {f.id}, "file": {rel}}
+	var info dbFile
+	err = query_syncthing(config.Url+"/rest/db/file?"+params.Encode(), &info)
+	if err, ok := err.(*statusError); ok && err.code == 404 {
+		// not in the index, e.g. because it is ignored or was not scanned yet
+		return report, nil
+	}
+	if err != nil {
+		return report, err
+	}
+	report.Known = true
+	report.InSync = info.inSync()
+	report.Ignored = info.Local.Ignored
+	// e.g. the name is not allowed here or it could not be synced
+	report.Invalid = info.Local.Invalid
+	report.Local = &info.Local
+	report.Global = &info.Global
+
+	mutex.Lock()
+	for _, id := range info.availableOn() {
+		if d, ok := device[id]; ok && d.name != "" {
+			id = d.name
+		}
+		report.Available = append(report.Available, id)
+	}
+	mutex.Unlock()
+
+	return report, nil
+}
+
+func printFileReport(report fileReport) {
+	fmt.Printf("File:       %s\n", report.Path)
+	fmt.Printf("Folder:     %s, %s\n", report.Folder, report.Name)
+	if !report.Known {
+		fmt.Println("Not in the index, it is ignored or was not scanned yet")
+		return
+	}
+	for _, v := range []struct {
+		name string
+		info *dbFileInfo
+	}{{"Local", report.Local}, {"Global", report.Global}} {
+		state := formatSize(float64(v.info.Size))
+		if v.info.Deleted {
+			state = "deleted"
+		}
+		fmt.Printf("%-11s %s, modified %s, version %s\n", v.name+":", state, v.info.Modified, compactJSON(v.info.Version))
+	}
+	fmt.Printf("In sync:    %s\n", yesNo(report.InSync))
+	fmt.Printf("Ignored:    %s\n", yesNo(report.Ignored))
+	fmt.Printf("Invalid:    %s\n", yesNo(report.Invalid))
+	fmt.Printf("Available:  %s\n", strings.Join(report.Available, ", "))
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
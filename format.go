@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+var iecPrefixes = []string{"", "Ki", "Mi", "Gi", "Ti"}
+var siPrefixes = []string{"", "k", "M", "G", "T"}
+
+// scale reduces value until it is shown with at most three digits, a value
+// that rounds up to 1000 already takes the next prefix
+func scale(value float64) (float64, string) {
+	base, prefixes := 1024.0, iecPrefixes
+	if config.units == "si" {
+		base, prefixes = 1000.0, siPrefixes
+	}
+
+	i := 0
+	for math.Abs(value) >= 999.5 && i < len(prefixes)-1 {
+		value /= base
+		i++
+	}
+	return value, prefixes[i]
+}
+
+// formatNumber prints three significant digits, e.g. 1.04, 12.3 or 300.
+// the precision is chosen for the rounded value, 9.996 is shown as 10.0.
+func formatNumber(value float64, prefix string) string {
+	switch {
+	case prefix == "":
+		return fmt.Sprintf("%.0f", value)
+	case math.Abs(value) < 9.995:
+		return fmt.Sprintf("%.2f", value)
+	case math.Abs(value) < 99.95:
+		return fmt.Sprintf("%.1f", value)
+	}
+	return fmt.Sprintf("%.0f", value)
+}
+
+// formatSize formats a number of bytes, e.g. "1.04 GiB"
+func formatSize(bytes float64) string {
+	value, prefix := scale(bytes)
+	return formatNumber(value, prefix) + " " + prefix + "B"
+}
+
+// formatRate formats a transfer rate given in bytes per second, e.g.
+// "12.3 MiB/s" or "103 Mbit/s"
+func formatRate(rate float64) string {
+	if !config.unitsBits {
+		return formatSize(rate) + "/s"
+	}
+	value, prefix := scale(rate * 8)
+	return formatNumber(value, prefix) + " " + prefix + "bit/s"
+}
+
+// formatRateCompact formats a transfer rate for the panel title, e.g. "12M"
+func formatRateCompact(rate float64) string {
+	if config.unitsBits {
+		rate *= 8
+	}
+	value, prefix := scale(rate)
+	prefix = strings.ToUpper(strings.TrimSuffix(prefix, "i"))
+	if prefix != "" && math.Abs(value) < 9.95 {
+		return fmt.Sprintf("%.1f%s", value, prefix)
+	}
+	return fmt.Sprintf("%.0f%s", value, prefix)
+}
+
+// formatUptime shows a duration in days, hours and minutes
+func formatUptime(d time.Duration) string {
+	minutes := int(d.Round(time.Minute).Minutes())
+	days, hours := minutes/(24*60), minutes/60%24
+	switch {
+	case days > 0:
+		return fmt.Sprintf("%dd %dh", days, hours)
+	case hours > 0:
+		return fmt.Sprintf("%dh %dm", hours, minutes%60)
+	}
+	return fmt.Sprintf("%dm", minutes)
+}
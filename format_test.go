@@ -0,0 +1,61 @@
+package main
+
+import "testing"
+
+func TestFormatRate(t *testing.T) {
+	const KiB, MiB = 1024.0, 1024.0 * 1024
+
+	cases := []struct {
+		units string
+		bits  bool
+		rate  float64
+		want  string
+	}{
+		{"iec", false, 0, "0 B/s"},
+		{"iec", false, 512, "512 B/s"},
+		{"iec", false, 999.4, "999 B/s"},
+		{"iec", false, 999.7, "0.98 KiB/s"},
+		{"iec", false, 1023.6, "1.00 KiB/s"},
+		{"iec", false, 1.5 * KiB, "1.50 KiB/s"},
+		{"iec", false, 9.996 * KiB, "10.0 KiB/s"},
+		{"iec", false, 12.34 * KiB, "12.3 KiB/s"},
+		{"iec", false, 99.96 * KiB, "100 KiB/s"},
+		{"iec", false, 300 * KiB, "300 KiB/s"},
+		{"iec", false, 999.7 * MiB, "0.98 GiB/s"},
+		{"si", false, 999.7, "1.00 kB/s"},
+		{"si", false, 9995, "10.0 kB/s"},
+		{"si", false, 999.7e6, "1.00 GB/s"},
+		{"si", true, 125, "1.00 kbit/s"},
+		{"si", true, 12.5e6, "100 Mbit/s"},
+	}
+	saved := config
+	defer func() { config = saved }()
+	for _, c := range cases {
+		config.units, config.unitsBits = c.units, c.bits
+		if got := formatRate(c.rate); got != c.want {
+			t.Errorf("formatRate(%v) with %s units, bits %v: got %q, want %q", c.rate, c.units, c.bits, got, c.want)
+		}
+	}
+}
+
+func TestFormatRateCompact(t *testing.T) {
+	cases := []struct {
+		rate float64
+		want string
+	}{
+		{0, "0"},
+		{900, "900"},
+		{999.7, "1.0K"},
+		{1536, "1.5K"},
+		{9.96 * 1024, "10K"},
+		{12.4 * 1024 * 1024, "12M"},
+	}
+	saved := config
+	defer func() { config = saved }()
+	config.units, config.unitsBits = "iec", false
+	for _, c := range cases {
+		if got := formatRateCompact(c.rate); got != c.want {
+			t.Errorf("formatRateCompact(%v): got %q, want %q", c.rate, got, c.want)
+		}
+	}
+}
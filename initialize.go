@@ -1,45 +1,25 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"log"
-	"math"
+	"log/slog"
 	"time"
-
-	"github.com/alex2108/systray"
 )
 
 func get_folder_state() error {
 	for key, rep := range folder {
 		mutex.Lock()
 		if folder[key].completion >= 0 {
-			log.Println("already got info for folder", key, "from events, skipping")
+			slog.Debug("already got folder state from events, skipping", "folder", key)
 			mutex.Unlock()
 			continue
 		}
-		r_json, err := query_syncthing(config.Url + "/rest/db/status?folder=" + rep.id)
-		log.Println("getting state for folder", rep.id)
+		var m folderSummary
+		err := query_syncthing(config.Url+"/rest/db/status?folder="+rep.id, &m)
+		slog.Debug("getting folder state", "folder", rep.id)
 		if err == nil {
-			type Folderstate struct {
-				NeedFiles   int
-				GlobalFiles int
-				State       string
-			}
-
-			var m Folderstate
-			json_err := json.Unmarshal([]byte(r_json), &m)
-
-			if json_err != nil {
-				mutex.Unlock()
-				return json_err
-			} else {
-
-				folder[key].state = m.State
-				folder[key].needFiles = m.NeedFiles
-				folder[key].completion = 100 - 100*float64(m.NeedFiles)/math.Max(float64(m.GlobalFiles), 1) // max to prevent division by zero
-
-			}
+			folder[key].state = m.State
+			folder[key].needFiles = m.NeedFiles
+			folder[key].completion = m.completion()
 		} else {
 			mutex.Unlock()
 			return err
@@ -56,22 +36,28 @@ func get_folder_state() error {
 func get_connections() error {
 	mutex.Lock()
 	defer mutex.Unlock()
-	log.Println("getting connections")
-	input, err := query_syncthing(config.Url + "/rest/system/connections")
+	slog.Debug("getting connections")
+	type deviceConnection struct {
+		Connected bool `json:"connected"`
+	}
+	var res struct {
+		Connections map[string]deviceConnection `json:"connections"`
+	}
+	err := query_syncthing(config.Url+"/rest/system/connections", &res)
 	if err != nil {
-		log.Println(err)
+		slog.Warn("could not get connections", "err", err)
 		return err
 	}
-	var res map[string]interface{}
-	err = json.Unmarshal([]byte(input), &res)
 
 	for deviceId, _ := range device {
 		device[deviceId].connected = false
 	}
 
-	for deviceId, m := range res["connections"].(map[string]interface{}) {
-		connectionState := m.(map[string]interface{})
-		device[deviceId].connected = connectionState["connected"].(bool)
+	for deviceId, c := range res.Connections {
+		// added after the config was read, it comes with the next ConfigSaved
+		if d, ok := device[deviceId]; ok {
+			d.connected = c.Connected
+		}
 	}
 
 	return err
@@ -85,23 +71,17 @@ func update_ul() error {
 		for _, n := range r_info.sharedWith {
 			mutex.Lock()
 			if device[n].folderCompletion[r] >= 0 {
-				log.Println("already got info for device", n, "folder", r, "from events, skipping")
+				slog.Debug("already got completion from events, skipping", "device", n, "folder", r)
 				mutex.Unlock()
 				continue
 			}
 
 			if device[n].connected { // only query connected devices
-				out, err := query_syncthing(config.Url + "/rest/db/completion?device=" + n + "&folder=" + r)
-				log.Println("updating upload status for device", n, "folder", r)
-				if err != nil {
-					log.Println(err)
-					mutex.Unlock()
-					return err
-				}
 				var m Completion
-				err = json.Unmarshal([]byte(out), &m)
+				err := query_syncthing(config.Url+"/rest/db/completion?device="+n+"&folder="+r, &m)
+				slog.Debug("updating upload status", "device", n, "folder", r)
 				if err != nil {
-					log.Println(err)
+					slog.Warn("could not get completion", "device", n, "folder", r, "err", err)
 					mutex.Unlock()
 					return err
 				}
@@ -122,16 +102,10 @@ func getStartTime() (string, error) {
 	type StStatus struct {
 		StartTime string
 	}
-	out, err := query_syncthing(config.Url + "/rest/system/status")
-
-	if err != nil {
-		log.Println(err)
-		return "", err
-	}
 	var m StStatus
-	err = json.Unmarshal([]byte(out), &m)
+	err := query_syncthing(config.Url+"/rest/system/status", &m)
 	if err != nil {
-		log.Println(err)
+		slog.Warn("could not get syncthing status", "err", err)
 		return "", err
 	}
 
@@ -141,138 +115,213 @@ func getStartTime() (string, error) {
 
 // helper to get a lock before starting the new thread that can run in background after a lock is aquired
 func initialize() {
-	// block all before config is read
+	if !startConnecting() {
+		slog.Debug("already connecting")
+		return
+	}
 
-	log.Println("wating for lock")
+	// block all before config is read
+	slog.Debug("waiting for lock")
 	mutex.Lock()
-	log.Println("wating for event lock")
+	slog.Debug("waiting for event lock")
 	eventMutex.Lock()
 	go initializeLocked()
 }
 
+// initializeLocked retries with backoff until syncthing is live again, mutex
+// and eventMutex must be held when it is started
 func initializeLocked() {
+	attempt := 0
+
+	// the event poll failed again after connecting, e.g. /rest/events
+	// answers with an error while everything else works. the backoff goes
+	// on from there instead of connecting again right away.
+	connMutex.Lock()
+	polls := failedPolls
+	connMutex.Unlock()
+	if polls > 1 {
+		mutex.Unlock()
+		eventMutex.Unlock()
+		delay := backoffDelay(polls - 2)
+		slog.Warn("reading events keeps failing", "failures", polls, "retryIn", delay.Round(time.Second))
+		waitBackoff(delay)
+		attempt = polls - 1
+	}
 
-	currentStartTime, err := getStartTime()
-	if err == nil {
+	for ; ; attempt++ {
+		if attempt > 0 {
+			setConnState(stateConnecting, time.Time{})
+			mutex.Lock()
+			eventMutex.Lock()
+		}
 
-		if startTime != currentStartTime {
-			log.Println("syncthing restarted at", currentStartTime)
-			startTime = currentStartTime
-			since_events = 0
+		err := probeHealth()
+		var currentStartTime string
+		if err == nil {
+			currentStartTime, err = getStartTime()
 		}
-		err = get_config()
-	}
+		if err == nil {
+
+			if startTime != currentStartTime {
+				slog.Info("syncthing restarted", "startTime", currentStartTime)
+				startTime = currentStartTime
+				since_events = 0
+			}
+			err = get_config()
+		}
+
+		// clean out old events
+		for len(eventChan) > 0 {
+			select {
+			case <-eventChan:
+				continue
+			default:
+				continue
+			}
+		}
+		mutex.Unlock()
+		eventMutex.Unlock()
 
-	// clean out old events
-	for len(eventChan) > 0 {
-		select {
-		case <-eventChan:
+		// get current state
+		if err == nil {
+			setConnState(stateInitialising, time.Time{})
+			err = get_folder_state()
+		}
+		if err == nil {
+			err = get_connections()
+		}
+		if err == nil {
+			err = update_ul()
+		}
+		if err == nil {
+			dataMutex.Lock()
+			connectionError = ""
+			connectionErrorClass = errorOther
+			dataMutex.Unlock()
+			if finishConnecting() {
+				break
+			}
+			slog.Info("config changed while connecting, reading it again")
 			continue
-		default:
+		}
+
+		if aborted(err) {
+			slog.Debug("request aborted, connecting again", "err", err)
 			continue
 		}
-	}
-	mutex.Unlock()
-	eventMutex.Unlock()
 
-	// get current state
-	if err == nil {
-		err = get_folder_state()
-	}
-	if err == nil {
-		err = get_connections()
-	}
-	if err == nil {
-		err = update_ul()
-	}
+		delay := backoffDelay(attempt)
+		class := classifyError(err)
+		if class.stopped() {
+			// nothing to fix, only worth a warning
+			slog.Warn(class.message(), "class", class, "err", err, "retryIn", delay.Round(time.Second))
+		} else {
+			slog.Error(class.message(), "class", class, "err", err, "hint", class.hint(), "retryIn", delay.Round(time.Second))
+		}
 
-	if err != nil {
-		eventMutex.Lock()
-		mutex.Lock()
-		log.Println(err)
-		log.Println("error getting syncthing config -> retry in 5s")
+		dataMutex.Lock()
+		connectionError = err.Error()
+		connectionErrorClass = class
+		recordError(err, class)
+		dataMutex.Unlock()
 
-		trayMutex.Lock()
-		trayEntries.stVersion.SetTitle(fmt.Sprintf("Syncthing: no connection to " + config.Url))
-		trayMutex.Unlock()
+		ui.showError(err)
 
-		systray.SetIcon(icon_error)
-		time.Sleep(5 * time.Second)
-		initializeLocked()
-		return
+		// nothing is locked while waiting
+		waitBackoff(delay)
 	}
+
+	mutex.Lock()
 	updateStatus()
+	mutex.Unlock()
 
 }
 func get_config() error {
-	log.Println("reading config from syncthing")
+	slog.Debug("reading config from syncthing")
 	//create empty state
 	device = make(map[string]*Device)
 	folder = make(map[string]*Folder)
 
-	r_json, err := query_syncthing(config.Url + "/rest/system/config")
-
-	if err == nil {
-		type SyncthingConfigDevice struct {
-			Deviceid string
-			Name     string
-		}
-		type SyncthingConfigFolderDevice struct {
-			Deviceid string
-		}
-
-		type SyncthingConfigFolder struct {
-			Id      string
-			Devices []SyncthingConfigFolderDevice
-		}
-		type SyncthingConfig struct {
-			Devices []SyncthingConfigDevice
-			Folders []SyncthingConfigFolder
-		}
+	type SyncthingConfigDevice struct {
+		Deviceid string
+		Name     string
+	}
+	type SyncthingConfigFolderDevice struct {
+		Deviceid string
+	}
 
-		var m SyncthingConfig
-		json_err := json.Unmarshal([]byte(r_json), &m)
+	type SyncthingConfigFolder struct {
+		Id      string
+		Path    string
+		Devices []SyncthingConfigFolderDevice
+	}
+	type SyncthingConfig struct {
+		Devices []SyncthingConfigDevice
+		Folders []SyncthingConfigFolder
+	}
 
-		if json_err != nil {
-			return json_err
-		} else { // save config in structs
+	var m SyncthingConfig
+	err := query_syncthing(config.Url+"/rest/system/config", &m)
+	if err != nil {
+		return err
+	}
 
-			//save Devices
-			for _, v := range m.Devices {
-				device[v.Deviceid] = &Device{v.Name, make(map[string]float64), false}
-			}
+	// save config in structs
+	//save Devices
+	for _, v := range m.Devices {
+		device[v.Deviceid] = &Device{v.Name, make(map[string]float64), false}
+	}
 
-			//save Folders
-			for _, v := range m.Folders {
-				folder[v.Id] = &Folder{v.Id, -1, "invalid", 0, make([]string, 0)} //id, completion, state, needFiles, sharedWith
-				for _, v2 := range v.Devices {
-					folder[v.Id].sharedWith = append(folder[v.Id].sharedWith, v2.Deviceid)
-					device[v2.Deviceid].folderCompletion[v.Id] = -1
-				}
+	//save Folders
+	for _, v := range m.Folders {
+		folder[v.Id] = &Folder{v.Id, v.Path, -1, "invalid", 0, make([]string, 0)} //id, path, completion, state, needFiles, sharedWith
+		for _, v2 := range v.Devices {
+			d, ok := device[v2.Deviceid]
+			if !ok {
+				continue // not in the device list, e.g. this device itself in old configs
 			}
-
+			folder[v.Id].sharedWith = append(folder[v.Id].sharedWith, v2.Deviceid)
+			d.folderCompletion[v.Id] = -1
 		}
-	} else {
-		return err
 	}
 
 	//Display version
-	log.Println("getting version")
-	resp, err := query_syncthing(config.Url + "/rest/system/version")
+	slog.Debug("getting version")
+	type STVersion struct {
+		Version string
+	}
+
+	var version STVersion
+	err = query_syncthing(config.Url+"/rest/system/version", &version)
 	if err == nil {
-		type STVersion struct {
-			Version string
-		}
+		dataMutex.Lock()
+		syncthingVersion = version.Version
+		dataMutex.Unlock()
+		slog.Info("connected to syncthing", "version", version.Version)
+		ui.showVersion(version.Version)
+	}
+	return err
+}
 
-		var m STVersion
-		err = json.Unmarshal([]byte(resp), &m)
-		if err == nil {
-			log.Println("displaying version")
-			trayMutex.Lock()
-			trayEntries.stVersion.SetTitle(fmt.Sprintf("Syncthing: %s", m.Version))
-			trayMutex.Unlock()
+// loadState reads the config and current state once, used by the commands
+// that do not follow the event stream
+func loadState() error {
+	if err := probeHealth(); err != nil {
+		return err
+	}
 
-		}
+	mutex.Lock()
+	err := get_config()
+	mutex.Unlock()
+
+	if err == nil {
+		err = get_folder_state()
+	}
+	if err == nil {
+		err = get_connections()
+	}
+	if err == nil {
+		err = update_ul()
 	}
 	return err
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// secretService keeps the api key in the freedesktop secret service, e.g.
+// gnome-keyring or kwallet, with the target as attribute
+type secretService struct{}
+
+func newKeyring() keyStore {
+	return secretService{}
+}
+
+const (
+	secretsName       = "org.freedesktop.secrets"
+	secretsPath       = "/org/freedesktop/secrets"
+	secretsInterface  = "org.freedesktop.Secret.Service"
+	defaultCollection = "/org/freedesktop/secrets/aliases/default"
+)
+
+// secret is the (oayays) struct of the secret service api
+type secret struct {
+	Session     dbus.ObjectPath
+	Parameters  []byte
+	Value       []byte
+	ContentType string
+}
+
+func (secretService) String() string {
+	return "keyring"
+}
+
+func (secretService) attributes() map[string]string {
+	return map[string]string{"application": "syncthing-tray", "target": config.target}
+}
+
+// open connects to the session bus and opens an unencrypted session, the
+// connection is private to the secret service
+func (s secretService) open() (*dbus.Conn, dbus.ObjectPath, error) {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return nil, "", err
+	}
+	var output dbus.Variant
+	var session dbus.ObjectPath
+	err = conn.Object(secretsName, secretsPath).Call(secretsInterface+".OpenSession", 0, "plain", dbus.MakeVariant("")).Store(&output, &session)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	return conn, session, nil
+}
+
+func (secretService) available() bool {
+	conn, err := dbus.ConnectSessionBus()
+	if err != nil {
+		return false
+	}
+	defer conn.Close()
+	var has bool
+	err = conn.BusObject().Call("org.freedesktop.DBus.NameHasOwner", 0, secretsName).Store(&has)
+	if err == nil && !has {
+		// the service may also be started on demand
+		var names []string
+		conn.BusObject().Call("org.freedesktop.DBus.ListActivatableNames", 0).Store(&names)
+		for _, name := range names {
+			has = has || name == secretsName
+		}
+	}
+	return err == nil && has
+}
+
+func (s secretService) apiKey() (string, error) {
+	conn, session, err := s.open()
+	if err != nil {
+		// no keyring is not an error, the key may not be needed
+		slog.Debug("secret service not available", "err", err)
+		return "", nil
+	}
+	defer conn.Close()
+
+	service := conn.Object(secretsName, secretsPath)
+	var unlocked, locked []dbus.ObjectPath
+	err = service.Call(secretsInterface+".SearchItems", 0, s.attributes()).Store(&unlocked, &locked)
+	if err != nil {
+		return "", err
+	}
+	if len(unlocked) == 0 && len(locked) > 0 {
+		// unlocking would need a prompt, there is nobody to answer it yet
+		slog.Warn("api key is in a locked keyring, unlock it and restart")
+		return "", nil
+	}
+	if len(unlocked) == 0 {
+		return "", nil
+	}
+
+	var sec secret
+	err = conn.Object(secretsName, unlocked[0]).Call("org.freedesktop.Secret.Item.GetSecret", 0, session).Store(&sec)
+	if err != nil {
+		return "", err
+	}
+	return string(sec.Value), nil
+}
+
+func (s secretService) store(key string) error {
+	conn, session, err := s.open()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	properties := map[string]dbus.Variant{
+		"org.freedesktop.Secret.Item.Label":      dbus.MakeVariant("Syncthing-Tray API key for " + config.target),
+		"org.freedesktop.Secret.Item.Attributes": dbus.MakeVariant(s.attributes()),
+	}
+	sec := secret{session, []byte{}, []byte(key), "text/plain"}
+
+	var item, prompt dbus.ObjectPath
+	err = conn.Object(secretsName, defaultCollection).Call("org.freedesktop.Secret.Collection.CreateItem", 0, properties, sec, true).Store(&item, &prompt)
+	if err != nil {
+		return err
+	}
+	if prompt != "/" {
+		// the collection is locked, the prompt asks the user to unlock it
+		return s.prompt(conn, prompt)
+	}
+	return nil
+}
+
+// prompt shows a prompt of the secret service and waits for it
+func (secretService) prompt(conn *dbus.Conn, prompt dbus.ObjectPath) error {
+	err := conn.AddMatchSignal(
+		dbus.WithMatchObjectPath(prompt),
+		dbus.WithMatchInterface("org.freedesktop.Secret.Prompt"),
+		dbus.WithMatchMember("Completed"),
+	)
+	if err != nil {
+		return err
+	}
+	signals := make(chan *dbus.Signal, 1)
+	conn.Signal(signals)
+
+	if err := conn.Object(secretsName, prompt).Call("org.freedesktop.Secret.Prompt.Prompt", 0, "").Err; err != nil {
+		return err
+	}
+	for s := range signals {
+		if s.Path != prompt || len(s.Body) == 0 {
+			continue
+		}
+		if dismissed, _ := s.Body[0].(bool); dismissed {
+			return fmt.Errorf("unlocking the keyring was dismissed")
+		}
+		return nil
+	}
+	return fmt.Errorf("connection to the secret service closed")
+}
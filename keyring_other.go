@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// noKeyring is used where there is no secret service
+type noKeyring struct{}
+
+func newKeyring() keyStore {
+	return noKeyring{}
+}
+
+func (noKeyring) String() string          { return "keyring" }
+func (noKeyring) apiKey() (string, error) { return "", nil }
+func (noKeyring) available() bool         { return false }
+
+func (noKeyring) store(key string) error {
+	return fmt.Errorf("no keyring on this system")
+}
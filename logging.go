@@ -0,0 +1,108 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sync"
+)
+
+// stateDir is where the tray keeps its own files, $XDG_STATE_HOME on unix
+func stateDir() string {
+	if dir := os.Getenv("XDG_STATE_HOME"); dir != "" {
+		return filepath.Join(dir, "syncthing-tray")
+	}
+	if runtime.GOOS != "windows" && runtime.GOOS != "darwin" {
+		if home, err := os.UserHomeDir(); err == nil {
+			return filepath.Join(home, ".local", "state", "syncthing-tray")
+		}
+	}
+	if dir, err := os.UserCacheDir(); err == nil {
+		return filepath.Join(dir, "syncthing-tray")
+	}
+	return filepath.Join(os.TempDir(), "syncthing-tray")
+}
+
+func logFilePath() string {
+	return filepath.Join(stateDir(), "syncthing-tray.log")
+}
+
+// rotatingFile is a log file that is moved to a backup once it reaches
+// maxSize, only the latest backup is kept
+type rotatingFile struct {
+	mu      sync.Mutex
+	path    string
+	maxSize int64
+	file    *os.File
+	size    int64
+}
+
+func openRotatingFile(path string, maxSize int64) (*rotatingFile, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return nil, err
+	}
+	r := &rotatingFile{path: path, maxSize: maxSize}
+	return r, r.open()
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.file, r.size = f, info.Size()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.size > 0 && r.size+int64(len(p)) > r.maxSize {
+		r.file.Close()
+		os.Rename(r.path, r.path+".1")
+		if err := r.open(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := r.file.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// setupLogging sends the log to w and, if enabled, to the log file
+func setupLogging(w io.Writer) error {
+	var level slog.Level
+	level.UnmarshalText([]byte(config.logLevel)) // checked by checkConfig
+	if config.verbose {
+		level = slog.LevelDebug
+	} else if config.quiet {
+		level = slog.LevelWarn
+	}
+
+	if config.logFile {
+		f, err := openRotatingFile(logFilePath(), int64(config.logMaxSize)*1024*1024)
+		if err != nil {
+			return err
+		}
+		// the file goes first, writing to stdout fails for windows gui builds
+		w = io.MultiWriter(f, w)
+	}
+
+	opts := &slog.HandlerOptions{Level: level, AddSource: config.verbose}
+	var handler slog.Handler
+	if config.logFormat == "json" {
+		handler = slog.NewJSONHandler(w, opts)
+	} else {
+		handler = slog.NewTextHandler(w, opts)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
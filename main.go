@@ -1,21 +1,18 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
+	"log/slog"
 	"math"
 	"os"
 	"os/signal"
-	"strconv"
 	"sync"
 	"syscall"
 	"time"
-
-	"github.com/alex2108/systray"
-	"github.com/toqueteos/webbrowser"
 )
+
 var VersionStr = "unknown"
 var BuildUnixTime = "0"
 
@@ -29,12 +26,39 @@ var eventChan = make(chan event, 10000)
 
 var inBytesRate float64
 var outBytesRate float64
-
+var inBytesTotal int64
+var outBytesTotal int64
+var lastEventPoll time.Time
+var reconnects int
+var syncthingVersion string // guarded by dataMutex like the values above
+var connectionError string
+var connectionErrorClass errorClass
+
+// folderSummary is sent with FolderSummary events and returned by
+// /rest/db/status
 type folderSummary struct {
-	NeedFiles   int    `json:"needFiles"`
-	State       string `json:"state"`
-	GlobalFiles int    `json:"globalFiles"`
-	NeedDeletes int    `json:"needDeletes"`
+	State           string `json:"state"`
+	GlobalFiles     int    `json:"globalFiles"`
+	GlobalBytes     int64  `json:"globalBytes"`
+	InSyncBytes     int64  `json:"inSyncBytes"`
+	NeedFiles       int    `json:"needFiles"`
+	NeedDirectories int    `json:"needDirectories"`
+	NeedSymlinks    int    `json:"needSymlinks"`
+	NeedDeletes     int    `json:"needDeletes"`
+	NeedBytes       int64  `json:"needBytes"`
+}
+
+// completion is calculated like the GUI of syncthing does: weighted by bytes,
+// deletes only count as items and keep it at 95% while nothing else is needed
+func (s folderSummary) completion() float64 {
+	needItems := s.NeedFiles + s.NeedDirectories + s.NeedSymlinks + s.NeedDeletes
+	if needItems == 0 {
+		return 100
+	}
+	if (s.NeedBytes == 0 && s.NeedDeletes > 0) || s.GlobalBytes == 0 {
+		return 95
+	}
+	return math.Floor(100 * float64(s.InSyncBytes) / float64(s.GlobalBytes))
 }
 
 type eventData struct {
@@ -53,10 +77,62 @@ type event struct {
 
 // config for connection to syncthing
 type Config struct {
-	Url      string
-	ApiKey   string
-	insecure bool
-	useRates bool
+	target     string // as given, for messages
+	Url        string // base url of requests, localhost for sockets
+	socketPath string
+	guiUrl     string
+	ApiKey     string
+
+	apiKeyFile   string
+	apiKeySource keySource // where ApiKey came from, nil without a key
+	insecure     bool
+	useRates     bool
+
+	caFile      string
+	fingerprint string
+	tofu        bool
+
+	clientCert             string
+	clientKey              string
+	clientCertPassword     string
+	clientCertPasswordFile string
+	serverName             string
+
+	user         string
+	password     string
+	passwordFile string
+	headers      headerList
+
+	proxy string
+
+	sshHost       string // host:port of ssh:// targets
+	sshUser       string
+	sshRemote     string // address of the GUI seen from the ssh host
+	sshKey        string
+	sshKnownHosts string
+	sshGuiPort    int
+
+	rateInterval  time.Duration
+	rateSmoothing float64
+
+	units      string
+	unitsBits  bool
+	titleRates bool
+
+	metricsAddr   string
+	controlSocket string
+	targetGiven   bool // commands only use a tray connected to the same target
+
+	verbose    bool
+	quiet      bool
+	logLevel   string
+	logFormat  string
+	logFile    bool
+	logMaxSize int
+
+	maxRetryDelay   time.Duration
+	logind          bool
+	maxResponseSize int
 }
 
 var config Config
@@ -73,6 +149,7 @@ var device map[string]*Device
 // configured folders
 type Folder struct {
 	id         string
+	path       string
 	completion float64
 	state      string
 	needFiles  int
@@ -82,22 +159,24 @@ type Folder struct {
 var folder map[string]*Folder
 
 func readEvents() error {
-	res, err := query_syncthing(fmt.Sprintf("%s/rest/events?since=%d", config.Url, since_events))
-
+	var events []event
+	pollStart := time.Now()
+	err := poll_syncthing(fmt.Sprintf("%s/rest/events?since=%d&timeout=%d", config.Url, since_events, int(eventPollTimeout.Seconds())), &events)
 	if err != nil {
 		return err
-	} else {
-		var events []event
-		err = json.Unmarshal([]byte(res), &events)
-		if err != nil {
-			return err
-		}
+	}
 
-		for _, event := range events {
-			eventChan <- event
-			since_events = event.ID
-		}
+	for _, event := range events {
+		eventChan <- event
+		since_events = event.ID
+	}
 
+	// only events sent while waiting tell how fast they arrive, older ones
+	// were just queued
+	if n := len(events); n > 0 && events[n-1].Time.After(pollStart) {
+		dataMutex.Lock()
+		eventLatency = time.Since(events[n-1].Time)
+		dataMutex.Unlock()
 	}
 	return nil
 }
@@ -107,33 +186,36 @@ func eventProcessor() {
 		mutex.Lock() // mutex with initialitze which may still be running
 		// handle different events
 		if event.Type == "FolderSummary" {
-			folder[event.Data.Folder].needFiles = event.Data.Summary.NeedFiles
-			folder[event.Data.Folder].state = event.Data.Summary.State
-			folder[event.Data.Folder].state = event.Data.Summary.State
-			log.Println(event.Data.Summary.NeedDeletes)
-			if event.Data.Summary.NeedDeletes == 0 {
-			    folder[event.Data.Folder].completion = 100 - 100*float64(event.Data.Summary.NeedFiles)/math.Max(float64(event.Data.Summary.GlobalFiles), 1)
-            } else {
-                folder[event.Data.Folder].completion = 95
-            }
+			if f, ok := folder[event.Data.Folder]; ok {
+				f.needFiles = event.Data.Summary.NeedFiles
+				f.state = event.Data.Summary.State
+				f.completion = event.Data.Summary.completion()
+			}
 			updateStatus()
 
 		} else if event.Type == "FolderCompletion" {
-			device[event.Data.Device].folderCompletion[event.Data.Folder] = event.Data.Completion
-
+			// devices and folders that are not known yet come with the
+			// next ConfigSaved
+			if d, ok := device[event.Data.Device]; ok {
+				d.folderCompletion[event.Data.Folder] = event.Data.Completion
+			}
 			updateStatus()
 
 		} else if event.Type == "DeviceConnected" {
-			log.Println(event.Data.Id, "connected")
-			device[event.Data.Id].connected = true
+			slog.Info("device connected", "device", event.Data.Id)
+			if d, ok := device[event.Data.Id]; ok {
+				d.connected = true
+			}
 			updateStatus()
 
 		} else if event.Type == "DeviceDisconnected" {
-			log.Println(event.Data.Id, "disconnected")
-			device[event.Data.Id].connected = false
+			slog.Info("device disconnected", "device", event.Data.Id)
+			if d, ok := device[event.Data.Id]; ok {
+				d.connected = false
+			}
 			updateStatus()
 		} else if event.Type == "ConfigSaved" {
-			log.Println("got new config -> reinitialize")
+			slog.Info("got new config, reinitializing")
 			since_events = event.ID
 			mutex.Unlock()
 			initialize()
@@ -145,43 +227,108 @@ func eventProcessor() {
 
 func main_loop() {
 	for {
+		// events are already read while the state is fetched
+		waitForConnState(stateInitialising, stateLive)
+
 		eventMutex.Lock()
 		err := readEvents()
 		eventMutex.Unlock()
 		time.Sleep(time.Millisecond) // otherwise initialize does not have a chance to get the lock since it is aquired here instantly again
+
+		if aborted(err) {
+			// e.g. after a suspend, resync already connects again
+			slog.Debug("event poll aborted")
+			initialize()
+			waitForConnState(stateLive)
+			continue
+		}
+
+		connMutex.Lock()
+		if err != nil {
+			failedPolls++
+		} else {
+			failedPolls = 0
+		}
+		polls := failedPolls
+		connMutex.Unlock()
+
+		// only the first failure counts as lost connection, not the
+		// failed attempts while reconnecting
+		dataMutex.Lock()
+		if err != nil {
+			if polls == 1 {
+				reconnects++
+			}
+			class := classifyError(err)
+			connectionError, connectionErrorClass = err.Error(), class
+			recordError(err, class)
+		} else {
+			lastEventPoll = time.Now()
+		}
+		dataMutex.Unlock()
+
 		if err != nil {
 			initialize()
+			waitForConnState(stateLive)
 		}
 	}
 
 }
 
-func updateStatus() {
-	log.Println("updating status")
+// syncStatus is the aggregate state that decides which icon is shown
+type syncStatus struct {
+	Connected   int     `json:"connected"`
+	Downloading bool    `json:"downloading"`
+	Uploading   bool    `json:"uploading"`
+	Completion  float64 `json:"completion"` // average over all folders
+}
+
+// name of the state as shown by setIcon
+func (s syncStatus) name() string {
+	if s.Connected == 0 {
+		return "disconnected"
+	} else if s.Downloading && s.Uploading {
+		return "syncing"
+	} else if s.Downloading {
+		return "downloading"
+	} else if s.Uploading {
+		return "uploading"
+	}
+	return "idle"
+}
 
-	downloading := false
-	uploading := false
-	numConnected := 0
+// currentStatus needs mutex to be held by the caller
+func currentStatus() syncStatus {
+	var status syncStatus
 
+	known, completion := 0, 0.0
 	for _, fol_info := range folder {
 		//log.Printf("folder %v",fol)
 		//log.Printf("folder_info %v",fol_info)
 		if fol_info.completion < 100 {
-			downloading = true
+			status.Downloading = true
+		}
+		if fol_info.completion >= 0 {
+			known++
+			completion += fol_info.completion
 		}
 	}
+	status.Completion = 100
+	if known > 0 {
+		status.Completion = completion / float64(known)
+	}
 
 	for _, dev_info := range device {
 		//%log.Printf("device %v",dev)
 		//log.Printf("device_info %v",dev_info)
 
 		if dev_info.connected {
-			numConnected++
+			status.Connected++
 
 			for folderName, completion := range dev_info.folderCompletion {
 				if completion < 100 {
-					uploading = true
-					log.Println("DEBUG:",dev_info.name,folderName,completion)
+					status.Uploading = true
+					slog.Debug("folder not synced on device", "device", dev_info.name, "folder", folderName, "completion", completion)
 				}
 			}
 		}
@@ -190,137 +337,188 @@ func updateStatus() {
 
 	if config.useRates {
 		dataMutex.Lock()
-		if inBytesRate > 500 {
-			downloading = true
-		} else {
-			downloading = false
-		}
-		if outBytesRate > 500 {
-			uploading = true
-		} else {
-			uploading = false
-		}
+		status.Downloading = inBytesRate > 500
+		status.Uploading = outBytesRate > 500
 		dataMutex.Unlock()
 	}
 
-	log.Printf("connected %v", numConnected)
+	return status
+}
 
-	trayMutex.Lock()
-	trayEntries.connectedDevices.SetTitle(fmt.Sprintf("Connected to %d Devices", numConnected))
-	setIcon(numConnected, downloading, uploading)
-	trayMutex.Unlock()
+func updateStatus() {
+	slog.Debug("updating status")
 
-}
+	status := currentStatus()
+	logTransitions(status)
 
-func setIcon(numConnected int, downloading, uploading bool) {
-	if numConnected == 0 {
-		//not connected
-		log.Println("not connected")
-		systray.SetIcon(icon_not_connected)
-
-	} else if downloading && uploading {
-		//ul+dl
-		log.Println("ul+dl")
-		systray.SetIcon(icon_ul_dl)
-	} else if downloading && !uploading {
-		//dl
-		log.Println("dl")
-		systray.SetIcon(icon_dl)
-	} else if !downloading && uploading {
-		//ul
-		log.Println("ul")
-		systray.SetIcon(icon_ul)
-	} else if !downloading && !uploading {
-		//idle
-		log.Println("idle")
-		systray.SetIcon(icon_idle)
-	}
+	slog.Debug("status", "state", status.name(), "connected", status.Connected)
 
+	ui.showStatus(status)
 }
 
-func main() {
-	// must be done at the beginning
-	systray.Run(setupTray)
+// addConfigFlags registers the options shared by the tray and all commands
+func addConfigFlags(fs *flag.FlagSet) {
+	fs.StringVar(&config.target, "target", "http://localhost:8384", "Target Syncthing instance, http(s)://host:port or unix(s):///path/to/socket")
+	fs.StringVar(&config.guiUrl, "gui-url", "", "address of the GUI opened in the browser, defaults to the target")
+	fs.StringVar(&config.ApiKey, "api", "", "Syncthing Api Key (used for password protected syncthing instance)")
+	fs.StringVar(&config.apiKeyFile, "api-file", "", "read the api key from this file, otherwise it is taken from $"+apiKeyEnv+", the keyring or the config.xml of a local syncthing")
+	fs.StringVar(&config.user, "user", "", "user name for the GUI login, instead of or together with the api key")
+	fs.StringVar(&config.password, "password", "", "password for the GUI login, visible to other users, prefer -password-file or $"+passwordEnv)
+	fs.StringVar(&config.passwordFile, "password-file", "", "read the password for the GUI login from this file")
+	fs.Var(&config.headers, "header", "extra header sent with every request as \"Name: value\", can be repeated")
+	fs.StringVar(&config.sshKey, "ssh-key", "", "private key for ssh:// targets, by default the ssh agent and ~/.ssh/id_* are used")
+	fs.StringVar(&config.sshKnownHosts, "ssh-known-hosts", "", "known hosts file for ssh:// targets, defaults to ~/.ssh/known_hosts")
+	fs.IntVar(&config.sshGuiPort, "ssh-gui-port", 0, "local port forwarded to the GUI of ssh:// targets, other users of this machine can connect to it, 0 disables the forward")
+	fs.StringVar(&config.proxy, "proxy", "", "proxy for connections to syncthing, http://, https:// or socks5://[user:password@]host:port, none to ignore the environment")
+	fs.BoolVar(&config.insecure, "i", false, "skip verification of SSL certificate")
+	fs.StringVar(&config.caFile, "ca", "", "verify the certificate of syncthing with the CA certificates in this PEM file")
+	fs.StringVar(&config.fingerprint, "fingerprint", "", "only accept the certificate with this SHA-256 fingerprint")
+	fs.BoolVar(&config.tofu, "tofu", false, "trust the certificate seen on first use and alert when it changes")
+	fs.StringVar(&config.clientCert, "client-cert", "", "client certificate for TLS, PEM or PKCS#12 (.p12, .pfx)")
+	fs.StringVar(&config.clientKey, "client-key", "", "PEM key of the client certificate, if it is not in the same file")
+	fs.StringVar(&config.clientCertPassword, "client-cert-password", "", "password of a PKCS#12 client certificate, visible to other users, prefer -client-cert-password-file or $"+clientCertPasswordEnv)
+	fs.StringVar(&config.clientCertPasswordFile, "client-cert-password-file", "", "read the password of a PKCS#12 client certificate from this file")
+	fs.StringVar(&config.serverName, "server-name", "", "server name sent with SNI and used to verify the certificate, defaults to the host of the target")
+	fs.BoolVar(&config.useRates, "R", false, "use transfer rates to determine upload/download state")
+	fs.DurationVar(&config.rateInterval, "rate-interval", 10*time.Second, "interval between transfer rate samples")
+	fs.Float64Var(&config.rateSmoothing, "rate-smoothing", 0, "EWMA smoothing factor for transfer rates between 0 and 1, 0 disables smoothing")
+	fs.StringVar(&config.units, "units", "iec", "unit prefixes for rates and sizes: iec (KiB, MiB) or si (kB, MB)")
+	fs.BoolVar(&config.unitsBits, "bits", false, "show transfer rates in bits per second")
+	fs.BoolVar(&config.titleRates, "title-rates", false, "show compact transfer rates next to the tray icon")
+	fs.StringVar(&config.metricsAddr, "metrics", "", "serve prometheus metrics on this address, e.g. 127.0.0.1:9110")
+	fs.StringVar(&config.controlSocket, "control-socket", defaultControlSocket(), "unix socket for the local status and control API, empty to disable")
+	fs.BoolVar(&config.verbose, "v", false, "verbose logging, including debug messages")
+	fs.BoolVar(&config.quiet, "q", false, "only log warnings and errors")
+	fs.StringVar(&config.logLevel, "log-level", "info", "log level: debug, info, warn or error, -v and -q override it")
+	fs.StringVar(&config.logFormat, "log-format", "text", "log format: text or json")
+	fs.BoolVar(&config.logFile, "log-file", false, "also write the log to "+logFilePath())
+	fs.IntVar(&config.logMaxSize, "log-max-size", 10, "size in MiB at which the log file is rotated")
+	fs.DurationVar(&config.maxRetryDelay, "max-retry-delay", 5*time.Minute, "longest delay between connection attempts")
+	fs.BoolVar(&config.logind, "logind", true, "resync after suspend when logind signals it (linux only)")
+	fs.IntVar(&config.maxResponseSize, "max-response-size", 64, "largest response in MiB accepted from syncthing")
 }
 
-type TrayEntries struct {
-	stVersion        *systray.MenuItem
-	connectedDevices *systray.MenuItem
-	rateDisplay      *systray.MenuItem
-	openBrowser      *systray.MenuItem
-	quit             *systray.MenuItem
+func checkConfig() error {
+	if err := resolveTarget(); err != nil {
+		return err
+	}
+	password, err := readSecret(config.clientCertPassword, config.clientCertPasswordFile, clientCertPasswordEnv)
+	if err != nil {
+		return fmt.Errorf("could not read client certificate password: %v", err)
+	}
+	config.clientCertPassword = password
+	if password, err = readSecret(config.password, config.passwordFile, passwordEnv); err != nil {
+		return fmt.Errorf("could not read password: %v", err)
+	}
+	config.password = password
+	if err := checkTLSConfig(); err != nil {
+		return err
+	}
+	if err := checkProxy(); err != nil {
+		return err
+	}
+	key, source, err := resolveApiKey(apiKeySources())
+	if err != nil {
+		return err
+	}
+	config.ApiKey, config.apiKeySource = key, source
+	if config.units != "iec" && config.units != "si" {
+		return fmt.Errorf("units must be iec or si")
+	}
+	if config.rateInterval <= 0 {
+		return fmt.Errorf("rate-interval must be positive")
+	}
+	if config.rateSmoothing < 0 || config.rateSmoothing > 1 {
+		return fmt.Errorf("rate-smoothing must be between 0 and 1")
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(config.logLevel)); err != nil {
+		return fmt.Errorf("log-level must be debug, info, warn or error")
+	}
+	if config.logFormat != "text" && config.logFormat != "json" {
+		return fmt.Errorf("log-format must be text or json")
+	}
+	if config.logMaxSize <= 0 {
+		return fmt.Errorf("log-max-size must be positive")
+	}
+	if config.maxRetryDelay < minRetryDelay {
+		return fmt.Errorf("max-retry-delay must be at least %s", minRetryDelay)
+	}
+	if config.maxResponseSize <= 0 {
+		return fmt.Errorf("max-response-size must be positive")
+	}
+	return nil
 }
 
-var trayEntries TrayEntries
-
-func setupTray() {
-	url := flag.String("target", "http://localhost:8384", "Target Syncthing instance")
-	api := flag.String("api", "", "Syncthing Api Key (used for password protected syncthing instance)")
-	insecure := flag.Bool("i", false, "skip verification of SSL certificate")
-	useRates := flag.Bool("R", false, "use transfer rates to determine upload/download state")
-	flag.Parse()
-
-	config.Url = *url
-	config.ApiKey = *api
-	config.insecure = *insecure
-	config.useRates = *useRates
-
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt)
-	signal.Notify(c, syscall.SIGTERM)
-	go func() {
-		<-c
-		systray.Quit()
-		os.Exit(0)
-	}()
-
-	log.SetOutput(os.Stdout)
-	log.SetFlags(log.LstdFlags | log.Lshortfile)
-    
-    buildInt, _ := strconv.Atoi(BuildUnixTime)
-    buildT := time.Unix(int64(buildInt), 0)
-    date := buildT.UTC().Format("2006-01-02 15:04:05 MST")
-	log.Println("Starting Syncthing-Tray",VersionStr,"-",date)
-	log.Println("Connecting to syncthing at", config.Url)
-	trayMutex.Lock()
+// startMonitor starts following syncthing in the background
+func startMonitor() {
 	go rate_reader()
+	if config.metricsAddr != "" {
+		go serveMetrics(config.metricsAddr)
+	}
+	if config.controlSocket != "" {
+		go serveControl(config.controlSocket)
+	}
+	if config.sshHost != "" && config.guiUrl == "" && config.sshGuiPort != 0 {
+		startGuiForward()
+	}
+	followSyncthing()
+}
+
+// followSyncthing keeps folder and device up to date from the event stream
+func followSyncthing() {
+	go watchClock()
+	if config.logind {
+		go watchSleep()
+	}
 	go eventProcessor()
 	go func() {
 		initialize()
 		main_loop()
 
 	}()
-	systray.SetIcon(icon_error)
-	systray.SetTitle("")
-	systray.SetTooltip("Syncthing-Tray")
+}
 
-	trayEntries.stVersion = systray.AddMenuItem("not connected", "Syncthing")
-	trayEntries.stVersion.Disable()
+func main() {
+	if len(os.Args) > 1 {
+		if command, ok := commands[os.Args[1]]; ok {
+			os.Exit(command(os.Args[2:]))
+		}
+	}
 
-	trayEntries.connectedDevices = systray.AddMenuItem("not connected", "Connected devices")
-	trayEntries.connectedDevices.Disable()
-	trayEntries.rateDisplay = systray.AddMenuItem("↓: 0 B/s ↑: 0 B/s", "Upload and download rate")
-	trayEntries.rateDisplay.Disable()
-	trayEntries.openBrowser = systray.AddMenuItem("Open Syncthing GUI", "opens syncthing GUI in default browser")
+	addConfigFlags(flag.CommandLine)
+	bar := flag.String("bar", "", "print status lines for a status bar instead of showing a tray icon: waybar, i3bar or plain")
+	if parseFlags(flag.CommandLine, os.Args[1:]) != nil {
+		os.Exit(2)
+	}
+	if err := checkConfig(); err != nil {
+		log.Fatal(err)
+	}
 
-	trayEntries.quit = systray.AddMenuItem("Quit", "Quit Syncthing-Tray")
-	go func() {
-		for {
-			select {
-			case <-trayEntries.quit.ClickedCh:
-				systray.Quit()
-				fmt.Println("Quit now...")
-				os.Exit(0)
-			case <-trayEntries.openBrowser.ClickedCh:
-				webbrowser.Open(config.Url)
-			}
+	switch *bar {
+	case "":
+		if err := setupLogging(os.Stdout); err != nil {
+			log.Fatal(err)
+		}
+	case "waybar", "i3bar", "plain":
+		// stdout belongs to the status bar
+		if err := setupLogging(os.Stderr); err != nil {
+			log.Fatal(err)
 		}
+		runBar(*bar)
+		return
+	default:
+		log.Fatal("bar must be waybar, i3bar or plain")
+	}
 
-	}()
-	trayMutex.Unlock()
+	runTray()
 }
 
-func onClick() { // not usable on ubuntu, left click also displays the menu
-	fmt.Println("Opening webinterface in browser")
-	webbrowser.Open(config.Url)
+// waitForShutdown blocks until the process is asked to quit
+func waitForShutdown() {
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
+	<-c
+	stopControl()
+	abortRequests()
 }
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// folderStatus is a response of /rest/db/status as sent by syncthing 1.27,
+// the needed items and bytes are filled in
+func folderStatus(globalBytes, inSyncBytes, needBytes int64, needFiles, needDeletes int, state string) string {
+	status := map[string]interface{}{
+		"errors": 0, "pullErrors": 0, "invalid": "", "ignorePatterns": false,
+		"globalBytes": globalBytes, "globalDeleted": 1406, "globalDirectories": 530,
+		"globalFiles": 6211, "globalSymlinks": 0, "globalTotalItems": 8147,
+		"inSyncBytes": inSyncBytes, "inSyncFiles": 6211 - needFiles,
+		"localBytes": inSyncBytes, "localDeleted": 1406, "localDirectories": 530,
+		"localFiles": 6211 - needFiles, "localSymlinks": 0, "localTotalItems": 8147,
+		"needBytes": needBytes, "needDeletes": needDeletes, "needDirectories": 0,
+		"needFiles": needFiles, "needSymlinks": 0, "needTotalItems": needFiles + needDeletes,
+		"receiveOnlyChangedBytes": 0, "receiveOnlyChangedDeletes": 0, "receiveOnlyChangedDirectories": 0,
+		"receiveOnlyChangedFiles": 0, "receiveOnlyChangedSymlinks": 0, "receiveOnlyTotalItems": 0,
+		"sequence": 9542, "state": state, "stateChanged": "2026-01-01T10:00:00Z", "version": 9542,
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		panic(err)
+	}
+	return string(data)
+}
+
+func TestFolderCompletion(t *testing.T) {
+	cases := []struct {
+		name       string
+		status     string
+		completion float64
+	}{
+		{"nothing needed", folderStatus(5637830537, 5637830537, 0, 0, 0, "idle"), 100},
+		{"only deletes needed", folderStatus(5637830537, 5637830537, 0, 0, 3, "syncing"), 95},
+		{"empty folder", folderStatus(0, 0, 0, 2, 0, "syncing"), 95},
+		{"partial sync", folderStatus(1000, 333, 667, 4, 0, "syncing"), 33},
+		{"partial sync rounds down", folderStatus(5637830537, 5637830536, 1, 1, 0, "syncing"), 99},
+	}
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// the same summary comes from /rest/db/status and with events
+			var status folderSummary
+			if err := json.Unmarshal([]byte(c.status), &status); err != nil {
+				t.Fatal(err)
+			}
+			if got := status.completion(); got != c.completion {
+				t.Errorf("db/status: got %v, want %v", got, c.completion)
+			}
+
+			var ev event
+			data := `{"id": 42, "globalID": 42, "type": "FolderSummary", "time": "2026-01-01T12:00:00Z",
+				"data": {"folder": "default", "summary": ` + c.status + `}}`
+			if err := json.Unmarshal([]byte(data), &ev); err != nil {
+				t.Fatal(err)
+			}
+			if got := ev.Data.Summary.completion(); got != c.completion {
+				t.Errorf("FolderSummary event: got %v, want %v", got, c.completion)
+			}
+		})
+	}
+}
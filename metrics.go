@@ -0,0 +1,145 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// metricsWriter writes the prometheus text exposition format
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m metricsWriter) header(name, kind, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// sample writes one value, labels are given as name, value pairs
+func (m metricsWriter) sample(name string, value float64, labels ...string) {
+	fmt.Fprint(m.w, name)
+	for i := 0; i+1 < len(labels); i += 2 {
+		sep := ","
+		if i == 0 {
+			sep = "{"
+		}
+		fmt.Fprintf(m.w, `%s%s="%s"`, sep, labels[i], labelEscaper.Replace(labels[i+1]))
+	}
+	if len(labels) > 0 {
+		fmt.Fprint(m.w, "}")
+	}
+	fmt.Fprintf(m.w, " %g\n", value)
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func sortedKeys(m map[string]float64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+type folderMetrics struct {
+	id         string
+	state      string
+	completion float64
+	needFiles  int
+}
+
+type deviceMetrics struct {
+	id         string
+	name       string
+	connected  bool
+	completion map[string]float64
+}
+
+func writeMetrics(w io.Writer) {
+	// copied before writing, a slow scraper must not hold up the locks
+	mutex.Lock()
+	folders := make([]folderMetrics, 0, len(folder))
+	for id, f := range folder {
+		folders = append(folders, folderMetrics{id, f.state, f.completion, f.needFiles})
+	}
+	devices := make([]deviceMetrics, 0, len(device))
+	for id, d := range device {
+		completion := make(map[string]float64, len(d.folderCompletion))
+		for folderId, c := range d.folderCompletion {
+			completion[folderId] = c
+		}
+		devices = append(devices, deviceMetrics{id, d.name, d.connected, completion})
+	}
+	mutex.Unlock()
+	sort.Slice(folders, func(i, j int) bool { return folders[i].id < folders[j].id })
+	sort.Slice(devices, func(i, j int) bool { return devices[i].id < devices[j].id })
+
+	dataMutex.Lock()
+	inRate, outRate := inBytesRate, outBytesRate
+	inTotal, outTotal := inBytesTotal, outBytesTotal
+	lastPoll := lastEventPoll
+	reconnectCount := reconnects
+	dataMutex.Unlock()
+
+	m := metricsWriter{w}
+	m.header("syncthing_tray_folder_completion_percent", "gauge", "Local completion of the folder, -1 if unknown.")
+	for _, f := range folders {
+		m.sample("syncthing_tray_folder_completion_percent", f.completion, "folder", f.id)
+	}
+	m.header("syncthing_tray_folder_need_files", "gauge", "Number of files the folder still needs.")
+	for _, f := range folders {
+		m.sample("syncthing_tray_folder_need_files", float64(f.needFiles), "folder", f.id)
+	}
+	m.header("syncthing_tray_folder_state", "gauge", "Current state of the folder.")
+	for _, f := range folders {
+		m.sample("syncthing_tray_folder_state", 1, "folder", f.id, "state", f.state)
+	}
+	m.header("syncthing_tray_device_connected", "gauge", "Whether the device is connected.")
+	for _, d := range devices {
+		m.sample("syncthing_tray_device_connected", boolValue(d.connected), "device", d.id, "name", d.name)
+	}
+	m.header("syncthing_tray_device_completion_percent", "gauge", "Completion of a folder on the device, -1 if unknown.")
+	for _, d := range devices {
+		for _, folderId := range sortedKeys(d.completion) {
+			m.sample("syncthing_tray_device_completion_percent", d.completion[folderId], "device", d.id, "name", d.name, "folder", folderId)
+		}
+	}
+
+	m.header("syncthing_tray_in_bytes_per_second", "gauge", "Download rate of all connections.")
+	m.sample("syncthing_tray_in_bytes_per_second", inRate)
+	m.header("syncthing_tray_out_bytes_per_second", "gauge", "Upload rate of all connections.")
+	m.sample("syncthing_tray_out_bytes_per_second", outRate)
+	m.header("syncthing_tray_in_bytes_total", "counter", "Bytes received since syncthing started.")
+	m.sample("syncthing_tray_in_bytes_total", float64(inTotal))
+	m.header("syncthing_tray_out_bytes_total", "counter", "Bytes sent since syncthing started.")
+	m.sample("syncthing_tray_out_bytes_total", float64(outTotal))
+	m.header("syncthing_tray_last_event_poll_timestamp_seconds", "gauge", "Time of the last successful event poll.")
+	if !lastPoll.IsZero() {
+		m.sample("syncthing_tray_last_event_poll_timestamp_seconds", float64(lastPoll.UnixNano())/1e9)
+	}
+	m.header("syncthing_tray_reconnects_total", "counter", "Number of times the connection to syncthing was lost.")
+	m.sample("syncthing_tray_reconnects_total", float64(reconnectCount))
+}
+
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		writeMetrics(w)
+	})
+
+	slog.Info("serving metrics", "addr", addr)
+	err := http.ListenAndServe(addr, mux)
+	slog.Error("metrics endpoint stopped", "err", err)
+}
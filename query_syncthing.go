@@ -1,53 +1,218 @@
 package main
 
 import (
-	"crypto/tls"
-	"log"
-	"time"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
 	"net"
 	"net/http"
-	"io/ioutil"
+	"net/http/cookiejar"
+	"strings"
+	"sync"
+	"time"
 )
 
-func query_syncthing(url string) (string, error) {
+// deadline for normal api calls
+const statusTimeout = 30 * time.Second
+
+// syncthing answers an event poll after this time even without new events,
+// the request itself gets statusTimeout on top
+const eventPollTimeout = 60 * time.Second
+
+var errUnauthorized = errors.New("invalid username or password")
+
+var errResponseTooLarge = errors.New("response exceeds max-response-size")
 
-	client := &http.Client{
+// only this much of an error response is kept for the message
+const maxErrorBody = 4096
+
+// one client is shared by all requests so connections are kept alive,
+// guarded by clientMutex. requests are aborted by cancelling requestCtx,
+// e.g. on shutdown or after a suspend.
+var clientMutex = &sync.Mutex{}
+var client *http.Client
+var requestCtx, cancelRequests = context.WithCancel(context.Background())
+
+func newClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout:   10 * time.Second,
+		KeepAlive: 30 * time.Second,
+	}
+	dial := dialer.DialContext
+	if config.socketPath != "" {
+		// the host of the url is only a placeholder
+		dial = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", config.socketPath)
+		}
+	}
+	if config.sshHost != "" {
+		dial = sshDial
+	}
+	// keeps the session and csrf cookies of the GUI
+	jar, _ := cookiejar.New(nil)
+	return &http.Client{
+		Jar: jar,
+		// gzip is requested and decoded by the transport itself as long as
+		// DisableCompression is false and no Accept-Encoding is set
 		Transport: &http.Transport{
-			Dial: func(netw, addr string) (net.Conn, error) {
-				conn, err := net.DialTimeout(netw, addr, time.Second*10)
-				if err != nil {
-					return nil, err
-				}
-				conn.SetDeadline(time.Now().Add(time.Second * 120))
-				return conn, nil
-			},
-			TLSClientConfig: &tls.Config{
-				InsecureSkipVerify: config.insecure,
-			},
-			ResponseHeaderTimeout: time.Second * 120,
+			Proxy:               proxyFunc(),
+			DialContext:         dial,
+			TLSClientConfig:     tlsConfig(),
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConnsPerHost: 4,
+			IdleConnTimeout:     90 * time.Second,
 		},
 	}
+}
 
+// syncthingClient returns the shared client and the context requests are
+// derived from
+func syncthingClient() (*http.Client, context.Context) {
+	clientMutex.Lock()
+	defer clientMutex.Unlock()
+	if client == nil {
+		client = newClient()
+	}
+	return client, requestCtx
+}
 
-	req, _ := http.NewRequest("GET", url, nil)
-	req.Header.Set("X-API-Key", config.ApiKey)
+// abortRequests cancels all requests that are in flight and drops idle
+// connections, they may be dead after a suspend
+func abortRequests() {
+	clientMutex.Lock()
+	cancelRequests()
+	requestCtx, cancelRequests = context.WithCancel(context.Background())
+	if client != nil {
+		client.CloseIdleConnections()
+	}
+	clientMutex.Unlock()
+	closeSSH()
+}
 
-	response, err := client.Do(req)
+// aborted is true for requests cancelled by abortRequests, nothing went
+// wrong with the connection then
+func aborted(err error) bool {
+	return errors.Is(err, context.Canceled)
+}
 
+// statusError is returned when syncthing answers with an error status
+type statusError struct {
+	code   int
+	status string
+	body   string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("%s: %s", e.status, e.body)
+}
+
+// limitedReader fails once more than n bytes are read, io.LimitReader
+// would silently cut the json instead
+type limitedReader struct {
+	r io.Reader
+	n int64
+}
+
+func (l *limitedReader) Read(p []byte) (int, error) {
+	if l.n <= 0 {
+		// only an error if there is more to read
+		var probe [1]byte
+		if n, _ := l.r.Read(probe[:]); n > 0 {
+			return 0, errResponseTooLarge
+		}
+		return 0, io.EOF
+	}
+	if int64(len(p)) > l.n {
+		p = p[:l.n]
+	}
+	n, err := l.r.Read(p)
+	l.n -= int64(n)
+	return n, err
+}
+
+// query_syncthing decodes the json answer into v
+func query_syncthing(url string, v interface{}) error {
+	return request_syncthing("GET", url, statusTimeout, v)
+}
+
+// poll_syncthing is used for the event long-poll which may take up to
+// eventPollTimeout
+func poll_syncthing(url string, v interface{}) error {
+	return request_syncthing("GET", url, eventPollTimeout+statusTimeout, v)
+}
+
+// post_syncthing sends a command like rescanning a folder
+func post_syncthing(url string) error {
+	return request_syncthing("POST", url, statusTimeout, nil)
+}
+
+// send_request sends a request with the configured credentials
+func send_request(ctx context.Context, client *http.Client, method, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, nil)
 	if err != nil {
-		log.Printf("ERROR: %s\n", err)
-		return "", err
-	} else {
-		defer response.Body.Close()
-		contents, err := ioutil.ReadAll(response.Body)
-		if response.StatusCode == 401 {
-			log.Fatal("Invalid username or password")
+		return nil, err
+	}
+	if needsCSRF() && !strings.HasPrefix(req.URL.Path, "/rest/noauth/") {
+		if _, token := csrfToken(client.Jar, req.URL); token == "" {
+			if err := fetchCSRFToken(ctx, client); err != nil {
+				return nil, err
+			}
 		}
-		if err != nil {
-			log.Printf("ERROR: %s\n", err)
-			return "", err
+	}
+	authorize(req, client.Jar)
+	return client.Do(req)
+}
+
+// request_syncthing sends a request that has to be answered within timeout,
+// the body is decoded into v unless it is nil
+func request_syncthing(method, url string, timeout time.Duration, v interface{}) error {
+	client, ctx := syncthingClient()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	response, err := send_request(ctx, client, method, url)
+	if err == nil && response.StatusCode == 403 && needsCSRF() {
+		// the csrf token is no longer valid, e.g. after syncthing restarted
+		closeBody(response.Body)
+		if err = fetchCSRFToken(ctx, client); err == nil {
+			response, err = send_request(ctx, client, method, url)
 		}
-		return string(contents), err
 	}
-	return "", err
+	if err != nil {
+		slog.Debug("request failed", "url", url, "err", err)
+		return err
+	}
+	defer closeBody(response.Body)
+
+	if response.StatusCode == 401 {
+		return errUnauthorized
+	}
+	if response.StatusCode >= 300 {
+		contents, _ := ioutil.ReadAll(io.LimitReader(response.Body, maxErrorBody))
+		err = &statusError{response.StatusCode, response.Status, strings.TrimSpace(string(contents))}
+		slog.Debug("request failed", "url", url, "err", err)
+		return err
+	}
+	if v == nil {
+		return nil
+	}
+
+	body := &limitedReader{response.Body, int64(config.maxResponseSize) << 20}
+	if err := json.NewDecoder(body).Decode(v); err != nil {
+		slog.Debug("decoding response failed", "url", url, "err", err)
+		return err
+	}
+	return nil
+}
+
+// closeBody reads the body to the end before closing it, otherwise the
+// connection is not reused. the decoder stops after the value and error
+// responses are cut off.
+func closeBody(body io.ReadCloser) {
+	io.Copy(io.Discard, io.LimitReader(body, int64(config.maxResponseSize)<<20))
+	body.Close()
 }
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// eventBatch is a response of /rest/events with n FolderSummary events
+func eventBatch(n int) []byte {
+	events := make([]map[string]interface{}, n)
+	start := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	for i := range events {
+		events[i] = map[string]interface{}{
+			"id":       i + 1,
+			"globalID": i + 1,
+			"type":     "FolderSummary",
+			"time":     start.Add(time.Duration(i) * time.Millisecond).Format(time.RFC3339Nano),
+			"data": map[string]interface{}{
+				"folder": fmt.Sprintf("folder-%d", i%20),
+				"summary": map[string]interface{}{
+					"globalBytes": 5637830537, "globalDeleted": 1406, "globalDirectories": 530,
+					"globalFiles": 6211, "globalSymlinks": 0, "globalTotalItems": 8147,
+					"ignorePatterns": false, "inSyncBytes": 5637830537 - int64(i), "inSyncFiles": 6210,
+					"invalid": "", "localBytes": 5637830537, "localDeleted": 1403,
+					"localDirectories": 530, "localFiles": 6211, "localSymlinks": 0,
+					"localTotalItems": 8144, "needBytes": i, "needDeletes": 0,
+					"needDirectories": 0, "needFiles": 1, "needSymlinks": 0,
+					"needTotalItems": 1, "pullErrors": 0, "sequence": 9500 + i,
+					"state": "syncing", "stateChanged": "2026-01-01T10:00:00Z", "version": 9500 + i,
+				},
+			},
+		}
+	}
+	data, err := json.Marshal(events)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// serveEvents points the client at a server answering every request with
+// payload
+func serveEvents(tb testing.TB, payload []byte) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(payload)
+	}))
+	saved := config
+	config.Url = srv.URL
+	config.ApiKey = "key"
+	config.maxResponseSize = 64
+	client = nil
+	tb.Cleanup(func() {
+		srv.Close()
+		config = saved
+		client = nil
+		since_events = 0
+	})
+}
+
+func drainEvents() int {
+	n := 0
+	for {
+		select {
+		case <-eventChan:
+			n++
+		default:
+			return n
+		}
+	}
+}
+
+func TestReadEvents(t *testing.T) {
+	serveEvents(t, eventBatch(100))
+	if err := readEvents(); err != nil {
+		t.Fatal(err)
+	}
+	if n := drainEvents(); n != 100 {
+		t.Errorf("got %d events, want 100", n)
+	}
+	if since_events != 100 {
+		t.Errorf("since_events is %d, want 100", since_events)
+	}
+}
+
+func TestReadEventsTooLarge(t *testing.T) {
+	serveEvents(t, eventBatch(100))
+	config.maxResponseSize = 0
+	if err := readEvents(); classifyError(err) != errorResponse {
+		t.Errorf("got %v, want a response that is too large", err)
+	}
+	drainEvents()
+}
+
+func BenchmarkReadEvents(b *testing.B) {
+	payload := eventBatch(10000)
+	serveEvents(b, payload)
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		since_events = 0
+		if err := readEvents(); err != nil {
+			b.Fatal(err)
+		}
+		drainEvents()
+	}
+}
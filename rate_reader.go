@@ -1,37 +1,93 @@
 package main
 
 import (
-	"encoding/json"
-	"fmt"
-	"log"
+	"log/slog"
 	"time"
 )
 
+// rateSample is one reading of the transfer totals reported by syncthing
+type rateSample struct {
+	at        time.Time
+	inBytes   int64
+	outBytes  int64
+	startTime string
+}
+
+// rateEstimator turns consecutive samples into transfer rates
+type rateEstimator struct {
+	smoothing float64 // EWMA factor, 0 disables smoothing
+	prev      *rateSample
+	in        float64
+	out       float64
+	valid     bool
+}
+
+// add updates the rates with a new sample. After a counter reset (syncthing
+// restarted or the totals went backwards) the sample only becomes the new
+// baseline, otherwise a restart shows up as a huge spike.
+func (r *rateEstimator) add(s rateSample) {
+	prev := r.prev
+	r.prev = &s
+	if prev == nil || s.startTime != prev.startTime || s.inBytes < prev.inBytes || s.outBytes < prev.outBytes {
+		r.in, r.out, r.valid = 0, 0, false
+		return
+	}
+
+	elapsed := s.at.Sub(prev.at).Seconds()
+	if elapsed <= 0 {
+		// same reading as before, keep the older baseline
+		r.prev = prev
+		return
+	}
+
+	in := float64(s.inBytes-prev.inBytes) / elapsed
+	out := float64(s.outBytes-prev.outBytes) / elapsed
+	if r.valid && r.smoothing > 0 && r.smoothing < 1 {
+		in = r.smoothing*in + (1-r.smoothing)*r.in
+		out = r.smoothing*out + (1-r.smoothing)*r.out
+	}
+	r.in, r.out, r.valid = in, out, true
+}
+
+// reset drops the baseline, e.g. after a failed read
+func (r *rateEstimator) reset() {
+	*r = rateEstimator{smoothing: r.smoothing}
+}
+
+// discardRates drops the baseline, the next sample would span a suspend
+var discardRates = make(chan struct{}, 1)
+
 func rate_reader() {
-	var prevInBytes int64
-	var prevOutBytes int64
-	var rateInterval int64 = 10
+	estimator := rateEstimator{smoothing: config.rateSmoothing}
+	ticker := time.NewTicker(config.rateInterval)
 
-	for range time.Tick(time.Duration(rateInterval) * time.Second) {
-		inBytes, outBytes, err := readRate()
+	for {
+		select {
+		case <-discardRates:
+			estimator.reset()
+			continue
+		case <-ticker.C:
+		}
+
+		sample, err := readRate()
 		if err != nil {
-			prevInBytes = 0
-			prevInBytes = 0
+			estimator.reset()
+		} else {
+			estimator.add(sample)
 		}
 
 		dataMutex.Lock()
-		inBytesRate = float64(inBytes-prevInBytes) / float64(rateInterval)
-		outBytesRate = float64(outBytes-prevOutBytes) / float64(rateInterval)
+		inBytesRate = estimator.in
+		outBytesRate = estimator.out
+		if err == nil {
+			inBytesTotal = sample.inBytes
+			outBytesTotal = sample.outBytes
+		}
 		dataMutex.Unlock()
 
-		prevInBytes = inBytes
-		prevOutBytes = outBytes
-
-		log.Println("inBytesRate:", formatRate(inBytesRate), "outBytesRate:", formatRate(outBytesRate))
+		slog.Debug("transfer rates", "in", formatRate(inBytesRate), "out", formatRate(outBytesRate))
 
-		trayMutex.Lock()
-		trayEntries.rateDisplay.SetTitle("↓: " + formatRate(inBytesRate) + " ↑:" + formatRate(outBytesRate))
-		trayMutex.Unlock()
+		ui.showRates(estimator.in, estimator.out)
 
 		if config.useRates {
 			mutex.Lock()
@@ -41,16 +97,7 @@ func rate_reader() {
 	}
 }
 
-func formatRate(rate float64) string {
-	if rate < 1024 { // 1 KiB
-		return fmt.Sprintf("%.2f B/s", rate)
-	} else if rate < 1024*1024 { // 1MiB
-		return fmt.Sprintf("%.2f KiB/s", rate/1024)
-	}
-	return fmt.Sprintf("%.2f MiB/s", rate/(1024*1024))
-}
-
-func readRate() (int64, int64, error) {
+func readRate() (rateSample, error) {
 
 	type connState struct {
 		Connected     bool   `json:"connected"`
@@ -64,13 +111,22 @@ func readRate() (int64, int64, error) {
 		Connections map[string]connState `json:"connections"`
 	}
 
-	input, err := query_syncthing(config.Url + "/rest/system/connections")
+	var res restConn
+	err := query_syncthing(config.Url+"/rest/system/connections", &res)
 	if err != nil {
-		log.Println(err)
-		return 0, 0, err
+		slog.Warn("could not read transfer rates", "err", err)
+		return rateSample{}, err
 	}
-	var res restConn
-	err = json.Unmarshal([]byte(input), &res)
 
-	return res.Total.InBytesTotal, res.Total.OutBytesTotal, nil
+	// prefer the server's timestamp, our own ticker may be delayed
+	at, err := time.Parse(time.RFC3339Nano, res.Total.At)
+	if err != nil {
+		at = time.Now()
+	}
+
+	mutex.Lock()
+	currentStartTime := startTime
+	mutex.Unlock()
+
+	return rateSample{at, res.Total.InBytesTotal, res.Total.OutBytesTotal, currentStartTime}, nil
 }
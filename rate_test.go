@@ -0,0 +1,141 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestRateEstimator(t *testing.T) {
+	t0 := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(seconds float64) time.Time {
+		return t0.Add(time.Duration(seconds * float64(time.Second)))
+	}
+
+	tests := []struct {
+		name      string
+		smoothing float64
+		samples   []rateSample
+		in, out   float64
+		valid     bool
+	}{
+		{
+			name:    "first sample",
+			samples: []rateSample{{at(0), 1000, 500, "s1"}},
+		},
+		{
+			name: "two samples",
+			samples: []rateSample{
+				{at(0), 1000, 500, "s1"},
+				{at(2), 3000, 1500, "s1"},
+			},
+			in: 1000, out: 500, valid: true,
+		},
+		{
+			name: "counter went backwards",
+			samples: []rateSample{
+				{at(0), 1000, 500, "s1"},
+				{at(2), 3000, 1500, "s1"},
+				{at(4), 100, 50, "s1"},
+			},
+		},
+		{
+			name: "restart keeps the counters",
+			samples: []rateSample{
+				{at(0), 1000, 500, "s1"},
+				{at(2), 3000, 1500, "s1"},
+				{at(4), 5000, 2500, "s2"},
+			},
+		},
+		{
+			name: "new baseline after restart",
+			samples: []rateSample{
+				{at(0), 1000, 500, "s1"},
+				{at(2), 100, 50, "s2"},
+				{at(3), 400, 150, "s2"},
+			},
+			in: 300, out: 100, valid: true,
+		},
+		{
+			name: "clock went backwards",
+			samples: []rateSample{
+				{at(0), 1000, 500, "s1"},
+				{at(2), 3000, 1500, "s1"},
+				{at(1), 4000, 2000, "s1"},
+			},
+			in: 1000, out: 500, valid: true,
+		},
+		{
+			name: "older baseline is kept after the clock went backwards",
+			samples: []rateSample{
+				{at(0), 1000, 500, "s1"},
+				{at(2), 3000, 1500, "s1"},
+				{at(1), 4000, 2000, "s1"},
+				{at(4), 7000, 3500, "s1"},
+			},
+			in: 2000, out: 1000, valid: true,
+		},
+		{
+			name: "same timestamp",
+			samples: []rateSample{
+				{at(0), 1000, 500, "s1"},
+				{at(0), 1000, 500, "s1"},
+			},
+		},
+		{
+			name:      "smoothing over several intervals",
+			smoothing: 0.5,
+			samples: []rateSample{
+				{at(0), 0, 0, "s1"},
+				{at(1), 1000, 0, "s1"},    // 1000
+				{at(2), 1000, 0, "s1"},    // 0.5*0 + 0.5*1000
+				{at(3), 5000, 1000, "s1"}, // 0.5*4000 + 0.5*500
+				{at(5), 5000, 1000, "s1"}, // 0.5*0 + 0.5*2250
+			},
+			in: 1125, out: 250, valid: true,
+		},
+		{
+			name:      "smoothing starts again after a reset",
+			smoothing: 0.5,
+			samples: []rateSample{
+				{at(0), 0, 0, "s1"},
+				{at(1), 1000, 0, "s1"},
+				{at(2), 0, 0, "s2"},
+				{at(3), 200, 100, "s2"},
+			},
+			in: 200, out: 100, valid: true,
+		},
+		{
+			name:      "smoothing of 1 is ignored",
+			smoothing: 1,
+			samples: []rateSample{
+				{at(0), 0, 0, "s1"},
+				{at(1), 1000, 0, "s1"},
+				{at(2), 1500, 0, "s1"},
+			},
+			in: 500, valid: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := rateEstimator{smoothing: tt.smoothing}
+			for _, s := range tt.samples {
+				r.add(s)
+			}
+			if r.valid != tt.valid || math.Abs(r.in-tt.in) > 1e-9 || math.Abs(r.out-tt.out) > 1e-9 {
+				t.Errorf("got in=%v out=%v valid=%v, want in=%v out=%v valid=%v", r.in, r.out, r.valid, tt.in, tt.out, tt.valid)
+			}
+		})
+	}
+}
+
+func TestRateEstimatorReset(t *testing.T) {
+	r := rateEstimator{smoothing: 0.3}
+	r.add(rateSample{time.Unix(0, 0), 0, 0, "s1"})
+	r.add(rateSample{time.Unix(1, 0), 100, 100, "s1"})
+	r.reset()
+	if r.valid || r.prev != nil || r.in != 0 || r.smoothing != 0.3 {
+		t.Errorf("reset left %+v", r)
+	}
+}
@@ -0,0 +1,33 @@
+//go:build !windows
+
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+)
+
+// fileOwner is the uid of the owner of the file
+func fileOwner(info os.FileInfo) int {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return int(stat.Uid)
+	}
+	return -1
+}
+
+// listenPrivate creates a unix socket that only the user can connect to.
+// the umask is not changed for it, it applies to the whole process and
+// other goroutines may be creating directories. the socket is in a
+// directory of the user, the chmod also covers sockets elsewhere.
+func listenPrivate(path string) (net.Listener, error) {
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		l.Close()
+		return nil, err
+	}
+	return l, nil
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+// fileOwner can not be told on windows, the temp dir belongs to the user
+func fileOwner(info os.FileInfo) int {
+	return os.Getuid()
+}
+
+// listenPrivate relies on the permissions of the directory on windows
+func listenPrivate(path string) (net.Listener, error) {
+	return net.Listen("unix", path)
+}
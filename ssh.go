@@ -0,0 +1,318 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// the ssh connection of ssh:// targets, guarded by sshMutex. it is opened
+// on the first request and again after it broke, so reconnecting follows
+// the retries of initialize. the mutex is not held while connecting, a slow
+// host would block closeSSH and every request.
+var sshMutex = &sync.Mutex{}
+var sshClient *ssh.Client
+
+// sshPending is the connection being opened, other requests wait for it
+var sshPending *sshAttempt
+
+type sshAttempt struct {
+	done   chan struct{}
+	client *ssh.Client
+	err    error
+}
+
+// guiForward is the local address forwarded to the GUI, empty if there is
+// no forward
+var guiForward string
+
+const sshKeepAlive = 30 * time.Second
+
+// sshDial opens a connection to addr on the other side of the tunnel
+func sshDial(ctx context.Context, network, addr string) (net.Conn, error) {
+	c, err := sshConnect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := c.Dial(network, addr)
+	if err != nil {
+		slog.Debug("could not open ssh channel", "addr", addr, "err", err)
+	}
+	return conn, err
+}
+
+// sshConnect returns the ssh connection and opens it if needed
+func sshConnect(ctx context.Context) (*ssh.Client, error) {
+	sshMutex.Lock()
+	if sshClient != nil {
+		client := sshClient
+		sshMutex.Unlock()
+		return client, nil
+	}
+	if attempt := sshPending; attempt != nil {
+		sshMutex.Unlock()
+		select {
+		case <-attempt.done:
+			return attempt.client, attempt.err
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+	attempt := &sshAttempt{done: make(chan struct{})}
+	sshPending = attempt
+	sshMutex.Unlock()
+
+	attempt.client, attempt.err = sshOpen(ctx)
+
+	sshMutex.Lock()
+	sshPending = nil
+	if attempt.err == nil {
+		sshClient = attempt.client
+		go watchSSH(attempt.client)
+	}
+	sshMutex.Unlock()
+	close(attempt.done)
+	return attempt.client, attempt.err
+}
+
+// sshOpen connects to the ssh host and authenticates
+func sshOpen(ctx context.Context) (*ssh.Client, error) {
+	// the agent is only needed for the handshake
+	agentConn := dialAgent()
+	if agentConn != nil {
+		defer agentConn.Close()
+	}
+	clientConfig, err := sshClientConfig(agentConn)
+	if err != nil {
+		return nil, err
+	}
+
+	slog.Info("connecting via ssh", "host", config.sshHost, "user", config.sshUser)
+	dialer := &net.Dialer{Timeout: 10 * time.Second, KeepAlive: 30 * time.Second}
+	conn, err := dialer.DialContext(ctx, "tcp", config.sshHost)
+	if err != nil {
+		return nil, err
+	}
+	// the handshake has no context, only a deadline
+	conn.SetDeadline(time.Now().Add(statusTimeout))
+	c, chans, reqs, err := ssh.NewClientConn(conn, config.sshHost, clientConfig)
+	if err != nil {
+		conn.Close()
+		var keyErr *knownhosts.KeyError
+		if errors.As(err, &keyErr) && len(keyErr.Want) == 0 {
+			return nil, fmt.Errorf("host key of %s is not known, connect once with ssh to add it to known_hosts: %w", config.sshHost, err)
+		}
+		return nil, fmt.Errorf("ssh to %s: %w", config.sshHost, err)
+	}
+	conn.SetDeadline(time.Time{})
+	return ssh.NewClient(c, chans, reqs), nil
+}
+
+// watchSSH sends keepalives and forgets the connection once it is closed
+func watchSSH(client *ssh.Client) {
+	done := make(chan struct{})
+	go func() {
+		err := client.Wait()
+		slog.Info("ssh connection closed", "host", config.sshHost, "err", err)
+		close(done)
+	}()
+
+	ticker := time.NewTicker(sshKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				client.Close()
+			}
+		case <-done:
+			sshMutex.Lock()
+			if sshClient == client {
+				sshClient = nil
+			}
+			sshMutex.Unlock()
+			return
+		}
+	}
+}
+
+// closeSSH drops the ssh connection, e.g. after a suspend it is dead
+func closeSSH() {
+	sshMutex.Lock()
+	if sshClient != nil {
+		sshClient.Close()
+		sshClient = nil
+	}
+	sshMutex.Unlock()
+}
+
+func dialAgent() net.Conn {
+	sock := os.Getenv("SSH_AUTH_SOCK")
+	if sock == "" {
+		return nil
+	}
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		slog.Debug("could not connect to ssh agent", "err", err)
+		return nil
+	}
+	return conn
+}
+
+func sshClientConfig(agentConn net.Conn) (*ssh.ClientConfig, error) {
+	hostKeyCallback, err := knownhosts.New(knownHostsFiles()...)
+	if err != nil {
+		return nil, fmt.Errorf("could not read known hosts: %v", err)
+	}
+	signers := func() ([]ssh.Signer, error) {
+		return sshSigners(agentConn)
+	}
+	return &ssh.ClientConfig{
+		User:              config.sshUser,
+		Auth:              []ssh.AuthMethod{ssh.PublicKeysCallback(signers)},
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms(hostKeyCallback),
+		Timeout:           10 * time.Second,
+	}, nil
+}
+
+func knownHostsFiles() []string {
+	if config.sshKnownHosts != "" {
+		return []string{expandHome(config.sshKnownHosts)}
+	}
+	var files []string
+	for _, f := range []string{expandHome("~/.ssh/known_hosts"), "/etc/ssh/ssh_known_hosts"} {
+		if _, err := os.Stat(f); err == nil {
+			files = append(files, f)
+		}
+	}
+	return files
+}
+
+// hostKeyAlgorithms prefers the key types known for the host, otherwise the
+// server may offer a key that is not in known_hosts
+func hostKeyAlgorithms(callback ssh.HostKeyCallback) []string {
+	// asked with a key that is not known, the callback lists the known ones
+	pub, _, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		return nil
+	}
+	placeholder, err := ssh.NewPublicKey(pub)
+	if err != nil {
+		return nil
+	}
+	var keyErr *knownhosts.KeyError
+	if !errors.As(callback(config.sshHost, &net.TCPAddr{IP: net.IPv4zero}, placeholder), &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+	for _, known := range keyErr.Want {
+		switch known.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, known.Key.Type())
+		}
+	}
+	return algorithms
+}
+
+// sshSigners offers the keys of the agent and then those in key files,
+// encrypted key files are left to the agent
+func sshSigners(agentConn net.Conn) ([]ssh.Signer, error) {
+	var signers []ssh.Signer
+	if agentConn != nil {
+		agentSigners, err := agent.NewClient(agentConn).Signers()
+		if err != nil {
+			slog.Debug("could not get keys from ssh agent", "err", err)
+		}
+		signers = append(signers, agentSigners...)
+	}
+
+	keyFiles := []string{config.sshKey}
+	if config.sshKey == "" {
+		keyFiles = nil
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			keyFiles = append(keyFiles, filepath.Join(expandHome("~/.ssh"), name))
+		}
+	}
+	for _, f := range keyFiles {
+		data, err := ioutil.ReadFile(expandHome(f))
+		if err != nil {
+			if config.sshKey != "" {
+				return nil, err
+			}
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			slog.Debug("could not use ssh key", "path", f, "err", err)
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no ssh keys, start an ssh agent or give -ssh-key")
+	}
+	return signers, nil
+}
+
+// startGuiForward listens on a local port and forwards it to the GUI so a
+// browser can open it. every user of this machine can connect to the port,
+// so it is only opened with -ssh-gui-port.
+func startGuiForward() {
+	l, err := net.Listen("tcp", fmt.Sprintf("127.0.0.1:%d", config.sshGuiPort))
+	if err != nil {
+		slog.Error("could not forward GUI", "err", err)
+		return
+	}
+	guiForward = "http://" + l.Addr().String()
+	slog.Info("forwarding GUI", "url", guiForward)
+
+	go func() {
+		for {
+			local, err := l.Accept()
+			if err != nil {
+				slog.Debug("GUI forward stopped", "err", err)
+				return
+			}
+			go forwardGui(local)
+		}
+	}()
+}
+
+func forwardGui(local net.Conn) {
+	defer local.Close()
+	remote, err := sshDial(context.Background(), "tcp", config.sshRemote)
+	if err != nil {
+		slog.Warn("could not forward GUI connection", "err", err)
+		return
+	}
+	defer remote.Close()
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(remote, local)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(local, remote)
+		done <- struct{}{}
+	}()
+	<-done
+}
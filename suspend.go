@@ -0,0 +1,47 @@
+package main
+
+import (
+	"log/slog"
+	"time"
+)
+
+const clockCheckInterval = 5 * time.Second
+
+// a difference this large between wall clock and monotonic clock means the
+// system was suspended, the monotonic clock does not advance meanwhile
+const clockJumpThreshold = 10 * time.Second
+
+// watchClock compares the wall clock with the monotonic clock to notice a
+// resume from suspend or a large clock change
+func watchClock() {
+	last := time.Now()
+	for range time.Tick(clockCheckInterval) {
+		now := time.Now()
+		monotonic := now.Sub(last)
+		wall := now.Round(0).Sub(last.Round(0))
+		last = now
+
+		jump := wall - monotonic
+		if jump > clockJumpThreshold || jump < -clockJumpThreshold || monotonic > clockCheckInterval+clockJumpThreshold {
+			slog.Info("clock jump detected, probably resumed from suspend", "jump", jump.Round(time.Second))
+			resync()
+		}
+	}
+}
+
+// resync drops everything that was in flight before a suspend and reads the
+// state from syncthing again
+func resync() {
+	abortRequests()
+
+	select {
+	case discardRates <- struct{}{}:
+	default:
+	}
+
+	if state, _ := getConnState(); state == stateBackoff {
+		triggerRetry()
+	} else {
+		initialize()
+	}
+}
@@ -0,0 +1,42 @@
+package main
+
+import (
+	"log/slog"
+
+	"github.com/godbus/dbus/v5"
+)
+
+// watchSleep listens for logind's PrepareForSleep signal, which is faster
+// and more reliable than waiting for watchClock to notice the jump
+func watchSleep() {
+	conn, err := dbus.ConnectSystemBus()
+	if err != nil {
+		slog.Debug("no system bus, not watching for suspend", "err", err)
+		return
+	}
+	defer conn.Close()
+
+	err = conn.AddMatchSignal(
+		dbus.WithMatchInterface("org.freedesktop.login1.Manager"),
+		dbus.WithMatchMember("PrepareForSleep"),
+	)
+	if err != nil {
+		slog.Debug("could not watch for suspend", "err", err)
+		return
+	}
+
+	signals := make(chan *dbus.Signal, 10)
+	conn.Signal(signals)
+	for s := range signals {
+		if s.Name != "org.freedesktop.login1.Manager.PrepareForSleep" || len(s.Body) != 1 {
+			continue
+		}
+		if sleeping, ok := s.Body[0].(bool); ok && sleeping {
+			slog.Info("going to sleep")
+			abortRequests()
+		} else if ok {
+			slog.Info("resumed from suspend")
+			resync()
+		}
+	}
+}
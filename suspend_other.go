@@ -0,0 +1,6 @@
+//go:build !linux
+
+package main
+
+// watchSleep only knows logind, other systems rely on watchClock
+func watchSleep() {}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os/user"
+	"strings"
+)
+
+// proxyURL is the proxy given with -proxy, nil if the environment decides
+var proxyURL *url.URL
+
+// resolveTarget sets the url requests are sent to from -target. syncthing
+// can listen on a unix socket given as unix:///path or unixs:///path for
+// https, requests then go to localhost and are dialed to the socket.
+// ssh://user@host:port/127.0.0.1:8384 tunnels the requests through ssh.
+func resolveTarget() error {
+	config.socketPath = ""
+	config.sshHost = ""
+	u, err := url.Parse(config.target)
+	if err != nil {
+		return fmt.Errorf("invalid target: %v", err)
+	}
+
+	switch u.Scheme {
+	case "http", "https":
+		config.Url = strings.TrimSuffix(config.target, "/")
+	case "unix", "unixs":
+		if u.Path == "" {
+			return fmt.Errorf("target %s has no socket path", config.target)
+		}
+		config.socketPath = u.Path
+		config.Url = "http://localhost"
+		if u.Scheme == "unixs" {
+			config.Url = "https://localhost"
+		}
+	case "ssh":
+		config.sshRemote = strings.TrimPrefix(u.Path, "/")
+		if _, _, err := net.SplitHostPort(config.sshRemote); err != nil {
+			return fmt.Errorf("target %s needs the address of the GUI on the host, e.g. ssh://host/127.0.0.1:8384", config.target)
+		}
+		config.sshHost = u.Host
+		if u.Port() == "" {
+			config.sshHost = net.JoinHostPort(u.Hostname(), "22")
+		}
+		config.sshUser = u.User.Username()
+		if config.sshUser == "" {
+			if current, err := user.Current(); err == nil {
+				config.sshUser = current.Username
+			}
+		}
+		config.Url = "http://" + config.sshRemote
+	default:
+		return fmt.Errorf("target must be a http, https, unix, unixs or ssh url")
+	}
+	return nil
+}
+
+// guiUrl is the address of the GUI for a browser, empty if the GUI is only
+// reachable through a socket or there is no forward through ssh
+func guiUrl() string {
+	if config.guiUrl != "" {
+		return strings.TrimSuffix(config.guiUrl, "/")
+	}
+	if config.sshHost != "" {
+		return guiForward
+	}
+	if config.socketPath != "" {
+		return ""
+	}
+	return config.Url
+}
+
+// remoteTarget is true if syncthing runs on another host, its folder paths
+// then do not exist here
+func remoteTarget() bool {
+	if config.sshHost != "" {
+		return true
+	}
+	if config.socketPath != "" {
+		return false
+	}
+	u, err := url.Parse(config.Url)
+	if err != nil {
+		return false
+	}
+	if u.Hostname() == "localhost" {
+		return false
+	}
+	ip := net.ParseIP(u.Hostname())
+	return ip == nil || !ip.IsLoopback()
+}
+
+func checkProxy() error {
+	proxyURL = nil
+	if config.proxy == "" || config.proxy == "none" {
+		return nil
+	}
+	u, err := url.Parse(config.proxy)
+	if err != nil {
+		return fmt.Errorf("invalid proxy: %v", err)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return fmt.Errorf("proxy must be a http, https, socks5 or socks5h url")
+	}
+	if u.Host == "" {
+		return fmt.Errorf("proxy has no host")
+	}
+	proxyURL = u
+	return nil
+}
+
+// proxyFunc decides which proxy a request goes through. without -proxy
+// HTTPS_PROXY, HTTP_PROXY and NO_PROXY are used, they never apply to
+// localhost.
+func proxyFunc() func(*http.Request) (*url.URL, error) {
+	if config.socketPath != "" || config.sshHost != "" || config.proxy == "none" {
+		return nil
+	}
+	if proxyURL != nil {
+		return http.ProxyURL(proxyURL)
+	}
+	return http.ProxyFromEnvironment
+}
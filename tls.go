@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// caPool holds the certificates of -ca and clientCert the one of
+// -client-cert, both are loaded by checkConfig
+var caPool *x509.CertPool
+var clientCert *tls.Certificate
+
+// known certificates for -tofu by target, guarded by tofuMutex. pendingCert
+// is the fingerprint seen last time it did not match.
+var tofuMutex = &sync.Mutex{}
+var knownCerts map[string]string
+var pendingCert string
+
+// certMismatchError is returned when the certificate of syncthing does not
+// have the pinned or recorded fingerprint
+type certMismatchError struct {
+	got, want string
+}
+
+func (e *certMismatchError) Error() string {
+	msg := fmt.Sprintf("certificate of %s has fingerprint %s, expected %s", config.target, formatFingerprint(e.got), formatFingerprint(e.want))
+	if config.tofu {
+		msg += ", trust it from the tray menu or remove it from " + knownCertsPath()
+	}
+	return msg
+}
+
+func knownCertsPath() string {
+	return filepath.Join(stateDir(), "known-certificates")
+}
+
+// normalizeFingerprint accepts the sha256 fingerprint as printed by openssl
+// or syncthing, with or without colons
+func normalizeFingerprint(fp string) string {
+	fp = strings.ToLower(fp)
+	fp = strings.NewReplacer(":", "", " ", "", "-", "").Replace(fp)
+	return fp
+}
+
+func formatFingerprint(fp string) string {
+	var parts []string
+	for i := 0; i+2 <= len(fp); i += 2 {
+		parts = append(parts, strings.ToUpper(fp[i:i+2]))
+	}
+	return strings.Join(parts, ":")
+}
+
+func checkTLSConfig() error {
+	set := 0
+	for _, on := range []bool{config.insecure, config.caFile != "", config.fingerprint != "", config.tofu} {
+		if on {
+			set++
+		}
+	}
+	if set > 1 {
+		return fmt.Errorf("only one of -i, -ca, -fingerprint and -tofu can be used")
+	}
+	// without tls they would be ignored and nothing would be verified
+	pinned := config.caFile != "" || config.fingerprint != "" || config.tofu
+	if pinned && !strings.HasPrefix(config.Url, "https://") {
+		return fmt.Errorf("-ca, -fingerprint and -tofu need an https:// or unixs:// target, %s does not use TLS", config.target)
+	}
+
+	if config.caFile != "" {
+		pem, err := ioutil.ReadFile(config.caFile)
+		if err != nil {
+			return err
+		}
+		caPool = x509.NewCertPool()
+		if !caPool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates found in %s", config.caFile)
+		}
+	}
+	if config.fingerprint != "" {
+		fp := normalizeFingerprint(config.fingerprint)
+		if b, err := hex.DecodeString(fp); err != nil || len(b) != sha256.Size {
+			return fmt.Errorf("fingerprint must be a sha256 hash in hex")
+		}
+		config.fingerprint = fp
+	}
+	if config.clientCert != "" {
+		cert, err := loadClientCert(config.clientCert, config.clientKey, config.clientCertPassword)
+		if err != nil {
+			return fmt.Errorf("could not load client certificate: %v", err)
+		}
+		clientCert = &cert
+	} else if config.clientKey != "" {
+		return fmt.Errorf("client-key needs client-cert")
+	}
+	if config.tofu {
+		return loadKnownCerts()
+	}
+	return nil
+}
+
+// loadClientCert reads a PKCS#12 file if it ends in .p12 or .pfx, otherwise
+// PEM with the key in keyFile or in the same file
+func loadClientCert(certFile, keyFile, password string) (tls.Certificate, error) {
+	data, err := ioutil.ReadFile(certFile)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	switch strings.ToLower(filepath.Ext(certFile)) {
+	case ".p12", ".pfx":
+		key, leaf, chain, err := pkcs12.DecodeChain(data, password)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		cert := tls.Certificate{Certificate: [][]byte{leaf.Raw}, PrivateKey: key, Leaf: leaf}
+		for _, ca := range chain {
+			cert.Certificate = append(cert.Certificate, ca.Raw)
+		}
+		return cert, nil
+	}
+
+	key := data
+	if keyFile != "" {
+		if key, err = ioutil.ReadFile(keyFile); err != nil {
+			return tls.Certificate{}, err
+		}
+	}
+	return tls.X509KeyPair(data, key)
+}
+
+// tlsConfig builds the tls settings of the client from the options
+func tlsConfig() *tls.Config {
+	c := &tls.Config{
+		InsecureSkipVerify: config.insecure,
+		RootCAs:            caPool,
+		ServerName:         config.serverName,
+	}
+	if clientCert != nil {
+		c.Certificates = []tls.Certificate{*clientCert}
+	}
+	if config.fingerprint != "" || config.tofu {
+		// the chain is not verified, the fingerprint of the certificate is
+		// all that counts
+		c.InsecureSkipVerify = true
+		c.VerifyPeerCertificate = verifyFingerprint
+	}
+	return c
+}
+
+func verifyFingerprint(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+	if len(rawCerts) == 0 {
+		return fmt.Errorf("no certificate received")
+	}
+	sum := sha256.Sum256(rawCerts[0])
+	got := hex.EncodeToString(sum[:])
+
+	if config.fingerprint != "" {
+		if got != config.fingerprint {
+			return &certMismatchError{got, config.fingerprint}
+		}
+		return nil
+	}
+
+	tofuMutex.Lock()
+	defer tofuMutex.Unlock()
+	want, ok := knownCerts[config.target]
+	if !ok {
+		slog.Info("trusting certificate on first use", "target", config.target, "fingerprint", formatFingerprint(got))
+		knownCerts[config.target] = got
+		if err := saveKnownCerts(); err != nil {
+			slog.Warn("could not save certificate fingerprint", "err", err)
+		}
+		return nil
+	}
+	if got != want {
+		pendingCert = got
+		return &certMismatchError{got, want}
+	}
+	pendingCert = ""
+	return nil
+}
+
+// trustPendingCert replaces the recorded fingerprint with the one that did
+// not match, returns false if there is none
+func trustPendingCert() bool {
+	tofuMutex.Lock()
+	defer tofuMutex.Unlock()
+	if pendingCert == "" {
+		return false
+	}
+	slog.Info("trusting new certificate", "target", config.target, "fingerprint", formatFingerprint(pendingCert))
+	knownCerts[config.target] = pendingCert
+	pendingCert = ""
+	if err := saveKnownCerts(); err != nil {
+		slog.Warn("could not save certificate fingerprint", "err", err)
+	}
+	return true
+}
+
+// the file has one "target fingerprint" pair per line
+func loadKnownCerts() error {
+	tofuMutex.Lock()
+	defer tofuMutex.Unlock()
+	knownCerts = make(map[string]string)
+	f, err := os.Open(knownCertsPath())
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 2 {
+			knownCerts[fields[0]] = fields[1]
+		}
+	}
+	return scanner.Err()
+}
+
+// saveKnownCerts needs tofuMutex
+func saveKnownCerts() error {
+	path := knownCertsPath()
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	targets := make([]string, 0, len(knownCerts))
+	for target := range knownCerts {
+		targets = append(targets, target)
+	}
+	sort.Strings(targets)
+
+	var b strings.Builder
+	for _, target := range targets {
+		fmt.Fprintf(&b, "%s %s\n", target, knownCerts[target])
+	}
+	// replaced at once so a crash does not leave half a file
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, []byte(b.String()), 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"log/slog"
+)
+
+// previous states for logging transitions, guarded by mutex
+var lastFolderState = make(map[string]string)
+var lastDeviceConnected = make(map[string]bool)
+var lastState string
+
+func connectedName(connected bool) string {
+	if connected {
+		return "connected"
+	}
+	return "disconnected"
+}
+
+// logTransitions logs what changed since the last status update, needs mutex
+func logTransitions(status syncStatus) {
+	for id, f := range folder {
+		if f.state == "invalid" {
+			continue // not known yet
+		}
+		if prev, ok := lastFolderState[id]; ok && prev != f.state {
+			slog.Info("transition", "folder", id, "from", prev, "to", f.state)
+		}
+		lastFolderState[id] = f.state
+	}
+
+	for id, d := range device {
+		if prev, ok := lastDeviceConnected[id]; ok && prev != d.connected {
+			slog.Info("transition", "device", id, "name", d.name, "from", connectedName(prev), "to", connectedName(d.connected))
+		}
+		lastDeviceConnected[id] = d.connected
+	}
+
+	if state := status.name(); state != lastState {
+		if lastState != "" {
+			slog.Info("transition", "status", "overall", "from", lastState, "to", state)
+		}
+		lastState = state
+	}
+}
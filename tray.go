@@ -0,0 +1,335 @@
+//go:build !notray
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/alex2108/systray"
+	"github.com/atotto/clipboard"
+	"github.com/toqueteos/webbrowser"
+)
+
+func setIcon(numConnected int, downloading, uploading bool) {
+	if numConnected == 0 {
+		//not connected
+		slog.Debug("setting icon", "icon", "not connected")
+		systray.SetIcon(icon_not_connected)
+
+	} else if downloading && uploading {
+		//ul+dl
+		slog.Debug("setting icon", "icon", "ul+dl")
+		systray.SetIcon(icon_ul_dl)
+	} else if downloading && !uploading {
+		//dl
+		slog.Debug("setting icon", "icon", "dl")
+		systray.SetIcon(icon_dl)
+	} else if !downloading && uploading {
+		//ul
+		slog.Debug("setting icon", "icon", "ul")
+		systray.SetIcon(icon_ul)
+	} else if !downloading && !uploading {
+		//idle
+		slog.Debug("setting icon", "icon", "idle")
+		systray.SetIcon(icon_idle)
+	}
+
+}
+
+type TrayEntries struct {
+	stVersion        *systray.MenuItem
+	connectedDevices *systray.MenuItem
+	rateDisplay      *systray.MenuItem
+	connState        *systray.MenuItem
+	retryNow         *systray.MenuItem
+	trustCert        *systray.MenuItem
+	saveApiKey       *systray.MenuItem
+	openBrowser      *systray.MenuItem
+	openLog          *systray.MenuItem
+	quit             *systray.MenuItem
+
+	// there are no submenus, diagnostics are a section of the menu
+	diagTray        *systray.MenuItem
+	diagTarget      *systray.MenuItem
+	diagSyncthing   *systray.MenuItem
+	diagPoll        *systray.MenuItem
+	diagErrors      []*systray.MenuItem
+	copyDiagnostics *systray.MenuItem
+}
+
+// errors shown in the menu, the copied diagnostics have all of them
+const menuErrors = 3
+
+var trayEntries TrayEntries
+
+func runTray() {
+	// must be done at the beginning
+	systray.Run(setupTray)
+}
+
+func setupTray() {
+	go func() {
+		waitForShutdown()
+		systray.Quit()
+		os.Exit(0)
+	}()
+
+	slog.Info("Starting Syncthing-Tray", "version", VersionStr, "built", buildDate())
+	slog.Info("Connecting to syncthing", "target", config.target)
+	trayMutex.Lock()
+	ui = trayDisplay{}
+	startMonitor()
+	systray.SetIcon(icon_error)
+	systray.SetTitle("")
+	systray.SetTooltip("Syncthing-Tray")
+
+	trayEntries.stVersion = systray.AddMenuItem("not connected", "Syncthing")
+	trayEntries.stVersion.Disable()
+
+	trayEntries.connectedDevices = systray.AddMenuItem("not connected", "Connected devices")
+	trayEntries.connectedDevices.Disable()
+	trayEntries.rateDisplay = systray.AddMenuItem("↓: "+formatRate(0)+" ↑: "+formatRate(0), "Upload and download rate")
+	trayEntries.rateDisplay.Disable()
+	trayEntries.connState = systray.AddMenuItem("Connection: "+stateDisconnected.String(), "State of the connection to syncthing")
+	trayEntries.connState.Disable()
+	trayEntries.retryNow = systray.AddMenuItem("Retry now", "Connect to syncthing without waiting")
+	trayEntries.retryNow.Disable()
+
+	// optional entries are handled by their own goroutines, only they exist
+	if config.tofu {
+		trayEntries.trustCert = systray.AddMenuItem("Trust new certificate", "Accept the changed certificate of syncthing")
+		trayEntries.trustCert.Disable()
+		go func() {
+			for range trayEntries.trustCert.ClickedCh {
+				if trustPendingCert() {
+					trayMutex.Lock()
+					trayEntries.trustCert.Disable()
+					trayMutex.Unlock()
+					triggerRetry()
+				}
+			}
+		}()
+	}
+
+	// offered while the key still comes from the command line, a file or
+	// the environment
+	if canSaveApiKey() {
+		trayEntries.saveApiKey = systray.AddMenuItem("Save API key to keyring", "Keep the API key in the keyring, -api is not needed afterwards")
+		go func() {
+			for range trayEntries.saveApiKey.ClickedCh {
+				saveApiKey()
+			}
+		}()
+	}
+
+	trayEntries.openBrowser = systray.AddMenuItem("Open Syncthing GUI", "opens syncthing GUI in default browser")
+	if guiUrl() == "" {
+		trayEntries.openBrowser.SetTooltip("the GUI can not be reached by a browser, set -gui-url or -ssh-gui-port to open it")
+		trayEntries.openBrowser.Disable()
+	}
+
+	if config.logFile {
+		trayEntries.openLog = systray.AddMenuItem("Open log", "opens the log file of Syncthing-Tray")
+		go func() {
+			for range trayEntries.openLog.ClickedCh {
+				webbrowser.Open(fileUrl(logFilePath()))
+			}
+		}()
+	}
+
+	trayEntries.diagTray = systray.AddMenuItem("Diagnostics: Syncthing-Tray "+VersionStr+", built "+buildDate(), "Version of Syncthing-Tray")
+	trayEntries.diagTray.Disable()
+	trayEntries.diagTarget = systray.AddMenuItem("Target: "+redactUrl(config.target), "Syncthing instance")
+	trayEntries.diagTarget.Disable()
+	trayEntries.diagSyncthing = systray.AddMenuItem("", "Version and uptime of syncthing")
+	trayEntries.diagSyncthing.Disable()
+	trayEntries.diagPoll = systray.AddMenuItem("", "Time since the last event poll and delay of the last event")
+	trayEntries.diagPoll.Disable()
+	for i := 0; i < menuErrors; i++ {
+		item := systray.AddMenuItem("", "Recent errors")
+		item.Disable()
+		trayEntries.diagErrors = append(trayEntries.diagErrors, item)
+	}
+	trayEntries.copyDiagnostics = systray.AddMenuItem("Copy diagnostics", "Copy a report for bug reports to the clipboard, secrets are left out")
+	// trayMutex is held until the menu is complete
+	go func() {
+		for {
+			showDiagnostics()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	trayEntries.quit = systray.AddMenuItem("Quit", "Quit Syncthing-Tray")
+	go func() {
+		for {
+			select {
+			case <-trayEntries.quit.ClickedCh:
+				stopControl()
+				systray.Quit()
+				slog.Info("Quit now...")
+				os.Exit(0)
+			case <-trayEntries.openBrowser.ClickedCh:
+				openGui("")
+			case <-trayEntries.copyDiagnostics.ClickedCh:
+				copyDiagnostics()
+			case <-trayEntries.retryNow.ClickedCh:
+				triggerRetry()
+			}
+		}
+
+	}()
+	trayMutex.Unlock()
+}
+
+// showDiagnostics updates the diagnostics section, also for the times
+// that change without any event
+func showDiagnostics() {
+	d := getDiagnostics()
+	trayMutex.Lock()
+	defer trayMutex.Unlock()
+	trayEntries.diagSyncthing.SetTitle(d.syncthingText())
+	trayEntries.diagPoll.SetTitle(d.pollText())
+	for i, item := range trayEntries.diagErrors {
+		title := ""
+		if i < len(d.errors) {
+			title = truncate(d.errors[i].String(), 80)
+		} else if i == 0 {
+			title = "No errors"
+		}
+		item.SetTitle(redactSecrets(title))
+	}
+}
+
+func truncate(s string, n int) string {
+	if r := []rune(s); len(r) > n {
+		return string(r[:n-1]) + "…"
+	}
+	return s
+}
+
+// copyDiagnostics puts the report on the clipboard, without a clipboard
+// tool it is opened as file instead
+func copyDiagnostics() {
+	report := getDiagnostics().report()
+	err := clipboard.WriteAll(report)
+	if err == nil {
+		slog.Info("copied diagnostics to the clipboard")
+		return
+	}
+	slog.Warn("could not copy diagnostics to the clipboard", "err", err)
+
+	path := filepath.Join(stateDir(), "diagnostics.txt")
+	if err := os.MkdirAll(stateDir(), 0700); err != nil {
+		slog.Error("could not write diagnostics", "err", err)
+		return
+	}
+	if err := ioutil.WriteFile(path, []byte(report), 0600); err != nil {
+		slog.Error("could not write diagnostics", "err", err)
+		return
+	}
+	webbrowser.Open(fileUrl(path))
+}
+
+// fileUrl turns a local path into a file:// url, on windows the drive
+// letter needs a slash in front
+func fileUrl(path string) string {
+	path = filepath.ToSlash(path)
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return (&url.URL{Scheme: "file", Path: path}).String()
+}
+
+func saveApiKey() {
+	err := keyring.store(config.ApiKey)
+	trayMutex.Lock()
+	defer trayMutex.Unlock()
+	if err != nil {
+		slog.Error("could not save api key to keyring", "err", err)
+		trayEntries.saveApiKey.SetTitle("Save API key to keyring (failed, see log)")
+		return
+	}
+	slog.Info("saved api key to keyring", "from", config.apiKeySource)
+	trayEntries.saveApiKey.SetTitle("API key saved to keyring")
+	trayEntries.saveApiKey.Disable()
+}
+
+func onClick() { // not usable on ubuntu, left click also displays the menu
+	slog.Info("Opening webinterface in browser")
+	openGui("")
+}
+
+// trayDisplay shows the state in the tray icon and its menu
+type trayDisplay struct{}
+
+func (trayDisplay) showVersion(version string) {
+	trayMutex.Lock()
+	trayEntries.stVersion.SetTitle(fmt.Sprintf("Syncthing: %s", version))
+	trayEntries.stVersion.SetTooltip("Syncthing")
+	if trayEntries.trustCert != nil {
+		trayEntries.trustCert.Disable()
+	}
+	trayMutex.Unlock()
+}
+
+func (trayDisplay) showError(err error) {
+	trayMutex.Lock()
+	class := classifyError(err)
+	trayEntries.stVersion.SetTitle(class.message())
+	trayEntries.stVersion.SetTooltip(config.target + ": " + err.Error())
+	// replaced by the number of devices once connected
+	trayEntries.connectedDevices.SetTitle("Hint: " + class.hint())
+
+	var certErr *certMismatchError
+	if errors.As(err, &certErr) {
+		trayEntries.stVersion.SetTitle("Certificate of syncthing changed!")
+		if trayEntries.trustCert != nil {
+			trayEntries.connectedDevices.SetTitle("Hint: trust the new certificate if the change is expected")
+			trayEntries.trustCert.Enable()
+		}
+	}
+
+	// red is for problems that need fixing, a stopped syncthing is grey
+	if class.stopped() {
+		systray.SetIcon(icon_not_connected)
+	} else {
+		systray.SetIcon(icon_error)
+	}
+	trayMutex.Unlock()
+}
+
+func (trayDisplay) showStatus(status syncStatus) {
+	trayMutex.Lock()
+	trayEntries.connectedDevices.SetTitle(fmt.Sprintf("Connected to %d Devices", status.Connected))
+	setIcon(status.Connected, status.Downloading, status.Uploading)
+	trayMutex.Unlock()
+}
+
+func (trayDisplay) showRates(in, out float64) {
+	trayMutex.Lock()
+	trayEntries.rateDisplay.SetTitle("↓: " + formatRate(in) + " ↑: " + formatRate(out))
+	if config.titleRates {
+		systray.SetTitle("↓" + formatRateCompact(in) + " ↑" + formatRateCompact(out))
+	}
+	trayMutex.Unlock()
+}
+
+func (trayDisplay) showConnection(state connState, nextRetry time.Time) {
+	trayMutex.Lock()
+	if state == stateBackoff {
+		trayEntries.connState.SetTitle("Connection: retrying at " + nextRetry.Format(time.TimeOnly))
+		trayEntries.retryNow.Enable()
+	} else {
+		trayEntries.connState.SetTitle("Connection: " + state.String())
+		trayEntries.retryNow.Disable()
+	}
+	trayMutex.Unlock()
+}
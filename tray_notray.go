@@ -0,0 +1,13 @@
+//go:build notray
+
+package main
+
+import (
+	"log"
+)
+
+// runTray is not available in builds without GTK, the daemon command and the
+// -bar option still work
+func runTray() {
+	log.Fatal("built without tray support, use the daemon command or -bar")
+}